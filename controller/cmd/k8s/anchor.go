@@ -0,0 +1,82 @@
+package k8s
+
+import (
+	"context"
+	"strconv"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// appName is the app.kubernetes.io/name of every object and what
+	// manages them.
+	appName          = "kubernetes-ssh"
+	memberIndexLabel = "ssh.zicongmei.github.io/member-index"
+)
+
+// anchorName is the ConfigMap that owns the objects of a cluster. Deleting
+// it garbage collects them.
+func anchorName(spec ClusterSpec) string {
+	return spec.NamePrefix + "-cluster"
+}
+
+// isAnchor reports whether an object is the anchor of its cluster.
+func isAnchor(o *unstructured.Unstructured) bool {
+	return o.GetKind() == "ConfigMap" &&
+		o.GetName() == anchorName(ClusterSpec{NamePrefix: o.GetLabels()[clusterLabel]})
+}
+
+// clusterLabels are the labels of every object of a cluster, the templates
+// add app.kubernetes.io/component.
+func clusterLabels(spec ClusterSpec) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":       appName,
+		"app.kubernetes.io/instance":   spec.NamePrefix,
+		"app.kubernetes.io/managed-by": appName,
+		clusterLabel:                   spec.NamePrefix,
+	}
+}
+
+// memberLabels are the labels of the objects of one member.
+func memberLabels(spec ClusterSpec, name string, index int) map[string]string {
+	labels := clusterLabels(spec)
+	labels[memberLabel] = name
+	labels[memberIndexLabel] = strconv.Itoa(index)
+	return labels
+}
+
+// setOwner makes anchor the owner of the objects that belong to its cluster
+// alone. PVCs are only owned when the retention policy deletes them, the
+// garbage collector would ignore the policy otherwise.
+func setOwner(spec ClusterSpec, objs []*unstructured.Unstructured, anchor *unstructured.Unstructured) {
+	ref := metaV1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       anchor.GetName(),
+		UID:        anchor.GetUID(),
+	}
+	for _, o := range objs {
+		if isShared(o) || isAnchor(o) {
+			continue
+		}
+		if o.GetKind() == "PersistentVolumeClaim" &&
+			spec.Persistence.RetentionPolicy != RetentionPolicyDelete {
+			continue
+		}
+		o.SetOwnerReferences([]metaV1.OwnerReference{ref})
+	}
+}
+
+// liveAnchor returns the anchor of a cluster as it exists in the cluster.
+func (p *Provisioner) liveAnchor(ctx context.Context, spec ClusterSpec) (*unstructured.Unstructured, error) {
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(coreV1.SchemeGroupVersion.WithKind("ConfigMap"))
+	key := types.NamespacedName{Namespace: spec.Namespace, Name: anchorName(spec)}
+	if err := p.clients.GetControllerClient().Get(ctx, key, live); err != nil {
+		return nil, &APIError{Verb: "get", Kind: "ConfigMap", Name: key.Name, Err: err}
+	}
+	return live, nil
+}
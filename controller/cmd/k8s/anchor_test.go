@@ -0,0 +1,110 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestClusterLabels(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 2, Probe: DefaultProbeSpec()}
+
+	keys := emptySSHKeys(spec.PodNum)
+	objs, err := generateObjs(spec, keys)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	for _, o := range objs {
+		labels := o.GetLabels()
+		if o.GetKind() == "Namespace" {
+			continue
+		}
+		g.Expect(labels).To(gomega.HaveKeyWithValue("app.kubernetes.io/name", "kubernetes-ssh"), o.GetName())
+		g.Expect(labels).To(gomega.HaveKey("app.kubernetes.io/component"), o.GetName())
+		if isShared(o) {
+			g.Expect(labels).NotTo(gomega.HaveKey("app.kubernetes.io/instance"), o.GetName())
+			continue
+		}
+		g.Expect(labels).To(gomega.HaveKeyWithValue("app.kubernetes.io/instance", "sample"), o.GetName())
+		g.Expect(labels).To(gomega.HaveKeyWithValue(clusterLabel, "sample"), o.GetName())
+	}
+
+	for _, o := range objs {
+		if o.GetKind() == "Deployment" && o.GetName() == "sample-1" {
+			g.Expect(o.GetLabels()).To(gomega.HaveKeyWithValue(memberIndexLabel, "1"))
+			g.Expect(o.GetLabels()).To(gomega.HaveKeyWithValue("app.kubernetes.io/component", "member"))
+		}
+	}
+}
+
+func TestApplyOwnedByAnchor(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+	spec.Persistence = PersistenceSpec{Enabled: true, Size: "1Gi", RetentionPolicy: RetentionPolicyKeep}
+
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	anchor := &coreV1.ConfigMap{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-cluster"}, anchor)).To(gomega.Succeed())
+	g.Expect(anchor.OwnerReferences).To(gomega.BeEmpty())
+	restored, err := ParseClusterSpec(anchor.Data["spec.yaml"])
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(restored.NamePrefix).To(gomega.Equal("sample"))
+
+	owned := []struct {
+		obj  ctrl.Object
+		name string
+	}{
+		{&coreV1.Secret{}, "sample-0"},
+		{&coreV1.Service{}, "sample-0"},
+		{&coreV1.ConfigMap{}, "sample-users"},
+	}
+	for _, o := range owned {
+		g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: o.name}, o.obj)).To(gomega.Succeed())
+		g.Expect(o.obj.GetOwnerReferences()).To(gomega.ConsistOf(
+			gomega.HaveField("Name", "sample-cluster")), o.name)
+	}
+
+	// The kept PVC and the shared bootstrap ConfigMap outlive the cluster.
+	notOwned := []struct {
+		obj  ctrl.Object
+		name string
+	}{
+		{&coreV1.PersistentVolumeClaim{}, "sample-0-home"},
+		{&coreV1.ConfigMap{}, bootstraptConfigMapName(podBootstrapt)},
+	}
+	for _, o := range notOwned {
+		g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: o.name}, o.obj)).To(gomega.Succeed())
+		g.Expect(o.obj.GetOwnerReferences()).To(gomega.BeEmpty(), o.name)
+	}
+
+	// Syncing the users keeps the owner.
+	g.Expect(provisioner.SyncUsers(ctx, spec)).To(gomega.Succeed())
+	users := &coreV1.ConfigMap{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-users"}, users)).To(gomega.Succeed())
+	g.Expect(users.OwnerReferences).To(gomega.HaveLen(1))
+}
+
+func TestSetOwnerRetention(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := ClusterSpec{NamePrefix: "sample"}
+	spec.Persistence.RetentionPolicy = RetentionPolicyDelete
+	anchor := &unstructured.Unstructured{}
+	anchor.SetName("sample-cluster")
+	anchor.SetUID("uid")
+	pvc := &unstructured.Unstructured{}
+	pvc.SetKind("PersistentVolumeClaim")
+
+	setOwner(spec, []*unstructured.Unstructured{pvc}, anchor)
+	g.Expect(pvc.GetOwnerReferences()).To(gomega.Equal([]metaV1.OwnerReference{{
+		APIVersion: "v1", Kind: "ConfigMap", Name: "sample-cluster", UID: "uid",
+	}}))
+}
@@ -0,0 +1,497 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// FailurePolicy decides what Apply does with the objects it created when a
+// later object fails.
+type FailurePolicy string
+
+const (
+	// FailurePolicyRollback deletes the objects created by the failed run in
+	// reverse order, so no Secret holding a private key is left behind.
+	FailurePolicyRollback FailurePolicy = "rollback"
+	// FailurePolicyKeep keeps them so the run can be resumed.
+	FailurePolicyKeep FailurePolicy = "keep"
+)
+
+const rollbackTimeout = 2 * time.Minute
+
+// isShared reports whether an object is shared by every cluster in the
+// namespace: the namespace and the bootstrap ConfigMap of each script.
+// Shared objects may already exist and are never rolled back.
+func isShared(o *unstructured.Unstructured) bool {
+	if o.GetKind() != "ConfigMap" {
+		return o.GetKind() == "Namespace"
+	}
+	script, found, _ := unstructured.NestedString(o.Object, "data", bootstraptKey)
+	return found && o.GetName() == bootstraptConfigMapName(script)
+}
+
+// isUsersConfigMap reports whether an object holds the keys of spec.Users.
+func isUsersConfigMap(o *unstructured.Unstructured) bool {
+	return o.GetKind() == "ConfigMap" &&
+		o.GetName() == usersConfigMapName(ClusterSpec{NamePrefix: o.GetLabels()[clusterLabel]})
+}
+
+// applyOrder creates Secrets before anything that starts pods. All keys are
+// therefore in place before the first member runs, which is what makes a
+// resumed run safe. Objects of the same order are created concurrently, an
+// order only starts once the previous one is complete.
+var applyOrder = map[string]int{
+	"Namespace":             0,
+	"ConfigMap":             2,
+	"NetworkPolicy":         3,
+	"Secret":                4,
+	"PersistentVolumeClaim": 5,
+	"Service":               6,
+	"Deployment":            7,
+}
+
+// anchorOrder creates the anchor on its own right after the namespace, the
+// objects after it need its UID for their owner references.
+const anchorOrder = 1
+
+func orderOf(o *unstructured.Unstructured) int {
+	if isAnchor(o) {
+		return anchorOrder
+	}
+	return applyOrder[o.GetKind()]
+}
+
+// ApplyOptions tunes a single Apply run.
+type ApplyOptions struct {
+	OnFailure FailurePolicy
+	// Resume continues a run that failed with FailurePolicyKeep: objects
+	// that already exist are kept and the member keys are read back from
+	// their Secrets.
+	Resume bool
+	// Workers bounds the concurrent key generations and API writes. Zero
+	// means DefaultWorkers.
+	Workers int
+	// AssumeNamespace treats a namespace that may not be created as
+	// existing. The installed controller sets it, a namespaced install is
+	// not granted namespaces.
+	AssumeNamespace bool
+}
+
+// DefaultWorkers is the default ApplyOptions.Workers.
+const DefaultWorkers = 8
+
+func (o ApplyOptions) workers() int {
+	if o.Workers < 1 {
+		return DefaultWorkers
+	}
+	return o.Workers
+}
+
+// isRetriable reports whether a write may succeed when retried: the server
+// throttled it, was unavailable, timed out or saw a conflicting update.
+func isRetriable(err error) bool {
+	return errors.IsTooManyRequests(err) || errors.IsServiceUnavailable(err) ||
+		errors.IsServerTimeout(err) || errors.IsTimeout(err) || errors.IsConflict(err)
+}
+
+// retryWrite runs write until it succeeds, fails with an error that is not
+// retriable or retry.DefaultBackoff is used up. A server that throttles or
+// is unavailable may ask for a delay with Retry-After, which is waited
+// instead of the backoff step when it is longer.
+func retryWrite(ctx context.Context, write func() error) error {
+	backoff := retry.DefaultBackoff
+	for {
+		err := write()
+		if err == nil || !isRetriable(err) || backoff.Steps <= 1 {
+			return err
+		}
+		delay := backoff.Step()
+		if seconds, ok := errors.SuggestsClientDelay(err); ok && time.Duration(seconds)*time.Second > delay {
+			delay = time.Duration(seconds) * time.Second
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// ApplyError reports a failed Apply together with what it left behind.
+type ApplyError struct {
+	// Err is the failure that stopped the run.
+	Err error
+	// Failed is the object that could not be created.
+	Failed *unstructured.Unstructured
+	// Created are the objects created by the run that still exist.
+	Created []*unstructured.Unstructured
+	// Pending are the objects that were never created.
+	Pending []*unstructured.Unstructured
+	// RolledBack lists the objects deleted again by the rollback.
+	RolledBack []*unstructured.Unstructured
+	// Kept are the shared objects created by the run, which the rollback
+	// leaves in place: other clusters or workloads may use them by now.
+	Kept []*unstructured.Unstructured
+	// RollbackErrors are the deletes that failed during the rollback.
+	RollbackErrors []error
+}
+
+func (e *ApplyError) Error() string {
+	if len(e.RolledBack) != 0 && len(e.Created) == 0 {
+		return fmt.Sprintf("%v, rolled back %d objects", e.Err, len(e.RolledBack))
+	}
+	return fmt.Sprintf("%v, %d objects left behind", e.Err, len(e.Created))
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// Report describes the state after the failure and how to resume.
+func (e *ApplyError) Report() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "apply failed: %v\n", e.Err)
+	section := func(title string, objs []*unstructured.Unstructured) {
+		if len(objs) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "%s:\n", title)
+		for _, o := range objs {
+			fmt.Fprintf(&b, "  %s/%s\n", o.GetKind(), o.GetName())
+		}
+	}
+	section("rolled back", e.RolledBack)
+	section("kept", e.Kept)
+	section("created", e.Created)
+	section("not created", e.Pending)
+	for _, err := range e.RollbackErrors {
+		fmt.Fprintf(&b, "rollback error: %v\n", err)
+	}
+	if len(e.Created) != 0 && len(e.RollbackErrors) == 0 {
+		b.WriteString("rerun with the same spec and -resume to create the rest\n")
+	}
+	return b.String()
+}
+
+// Apply validates the spec, renders every object of the cluster and creates
+// them in applyOrder. On failure it returns an *ApplyError; with the rollback
+// policy every object created by this run except the shared ones is deleted
+// again first.
+func (p *Provisioner) Apply(
+	ctx context.Context,
+	spec ClusterSpec,
+	options ApplyOptions) (*Result, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	switch options.OnFailure {
+	case "", FailurePolicyRollback, FailurePolicyKeep:
+	default:
+		return nil, &ValidationError{Errors: field.ErrorList{field.NotSupported(
+			field.NewPath("onFailure"), options.OnFailure,
+			[]string{string(FailurePolicyRollback), string(FailurePolicyKeep)})}}
+	}
+	if err := p.checkPodSecurity(ctx, spec); err != nil {
+		return nil, err
+	}
+	keys := emptySSHKeys(spec.PodNum)
+	if options.Resume {
+		// Members that are running keep their keys, only missing Secrets get
+		// new ones.
+		var err error
+		if keys, err = p.liveSSHKeys(ctx, spec); err != nil {
+			return nil, err
+		}
+		if missing := keys.missingMembers(spec); len(missing) != 0 && len(missing) != spec.PodNum {
+			glog.Warningf("generating keys for %s, the other members trust them once they restart",
+				strings.Join(missing, ", "))
+		}
+	}
+	keys, err := completeSSHKeys(ctx, spec, keys, options.workers())
+	if err != nil {
+		return nil, err
+	}
+	trustedKeys, err := readTrustedKeys(spec.Keys.TrustedKeys)
+	if err != nil {
+		return nil, err
+	}
+	keys.trustedKeys = trustedKeys
+	if keys.userKeys, err = p.resolveUserKeys(ctx, spec); err != nil {
+		return nil, err
+	}
+	if keys.revokedKeys, err = p.revokedKeys(ctx, spec); err != nil {
+		return nil, err
+	}
+	allObjs, err := generateObjs(spec, keys)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(allObjs, func(i, j int) bool {
+		return orderOf(allObjs[i]) < orderOf(allObjs[j])
+	})
+
+	result := &Result{}
+	for start := 0; start < len(allObjs); {
+		end := start + 1
+		for end < len(allObjs) && orderOf(allObjs[end]) == orderOf(allObjs[start]) {
+			end++
+		}
+		phase := allObjs[start:end]
+		outcomes := p.createAll(ctx, phase, options)
+
+		var failed *unstructured.Unstructured
+		var failErr error
+		var pending []*unstructured.Unstructured
+		for i, o := range phase {
+			switch outcome := outcomes[i]; {
+			case outcome.skipped:
+				pending = append(pending, o)
+			case outcome.err != nil && failErr == nil:
+				failed, failErr = o, outcome.err
+			case outcome.err != nil:
+				glog.Errorf("also failed: %v", outcome.err)
+				pending = append(pending, o)
+			case outcome.existing:
+				result.Existing = append(result.Existing, o)
+			default:
+				result.Created = append(result.Created, o)
+			}
+		}
+		if failErr == nil && len(pending) != 0 {
+			failed, failErr = pending[0], ctx.Err()
+			pending = pending[1:]
+		}
+		if failErr == nil && orderOf(phase[0]) == anchorOrder {
+			// A kept anchor has no UID yet.
+			anchor := phase[0]
+			if anchor.GetUID() == "" {
+				anchor, failErr = p.liveAnchor(ctx, spec)
+			}
+			if failErr == nil {
+				setOwner(spec, allObjs[end:], anchor)
+			} else {
+				failed = phase[0]
+			}
+		}
+		if failErr != nil {
+			pending = append(pending, allObjs[end:]...)
+			return result, p.fail(failErr, failed, result, pending, options)
+		}
+		start = end
+	}
+	return result, nil
+}
+
+// createOutcome is what happened to one object of createAll.
+type createOutcome struct {
+	existing bool
+	// skipped is set when the context was done before the object was tried.
+	skipped bool
+	err     error
+}
+
+// createAll creates objs on up to options.Workers goroutines. The outcomes
+// are in the order of objs, whatever order the writes finished in.
+func (p *Provisioner) createAll(
+	ctx context.Context,
+	objs []*unstructured.Unstructured,
+	options ApplyOptions) []createOutcome {
+	outcomes := make([]createOutcome, len(objs))
+	for i := range outcomes {
+		outcomes[i].skipped = true
+	}
+	workqueue.ParallelizeUntil(ctx, options.workers(), len(objs), func(i int) {
+		existing, err := p.create(ctx, objs[i], options)
+		outcomes[i] = createOutcome{existing: existing, err: err}
+	})
+	return outcomes
+}
+
+// create creates one object, retrying with retryWrite. It reports whether
+// the object already existed and was kept.
+func (p *Provisioner) create(
+	ctx context.Context,
+	o *unstructured.Unstructured,
+	options ApplyOptions) (bool, error) {
+	client := p.clients.GetControllerClient()
+	err := retryWrite(ctx, func() error {
+		return client.Create(ctx, o)
+	})
+	if errors.IsForbidden(err) && o.GetKind() == "Namespace" && options.AssumeNamespace {
+		glog.Infof("may not create %q object %q, assuming it exists", o.GetKind(), o.GetName())
+		return true, nil
+	}
+	if errors.IsAlreadyExists(err) && (isShared(o) || options.Resume) {
+		if err := p.resumeExisting(ctx, o); err != nil {
+			return false, err
+		}
+		glog.Infof("%q object %q already exists", o.GetKind(), o.GetName())
+		return true, nil
+	}
+	if err != nil {
+		return false, &APIError{Verb: "create", Kind: o.GetKind(), Name: o.GetName(), Err: err}
+	}
+	glog.Infof("created %q object %q", o.GetKind(), o.GetName())
+	return false, nil
+}
+
+// resumeExisting brings an existing object in line with a resumed run. Only
+// Secrets and the users ConfigMap are updated: the Secrets keep their keys
+// but trust those generated for the members whose Secrets were missing, and
+// the users may have changed since the failed run.
+func (p *Provisioner) resumeExisting(
+	ctx context.Context,
+	o *unstructured.Unstructured) error {
+	if o.GetKind() != "Secret" && !isUsersConfigMap(o) {
+		return nil
+	}
+	client := p.clients.GetControllerClient()
+	return retryWrite(ctx, func() error {
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(o.GroupVersionKind())
+		key := types.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}
+		if err := client.Get(ctx, key, live); err != nil {
+			return &APIError{Verb: "get", Kind: o.GetKind(), Name: o.GetName(), Err: err}
+		}
+		o.SetResourceVersion(live.GetResourceVersion())
+		keepLiveMetadata(o, live)
+		if err := client.Update(ctx, o); err != nil {
+			return &APIError{Verb: "update", Kind: o.GetKind(), Name: o.GetName(), Err: err}
+		}
+		return nil
+	})
+}
+
+// createOrUpdate creates an object or replaces the live one with it. Shared
+// objects are only created, others may have changed them.
+func (p *Provisioner) createOrUpdate(ctx context.Context, o *unstructured.Unstructured) error {
+	client := p.clients.GetControllerClient()
+	err := retryWrite(ctx, func() error {
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(o.GroupVersionKind())
+		key := types.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}
+		err := client.Get(ctx, key, live)
+		if errors.IsNotFound(err) {
+			return client.Create(ctx, o)
+		}
+		if err != nil || isShared(o) {
+			return err
+		}
+		o.SetResourceVersion(live.GetResourceVersion())
+		keepLiveMetadata(o, live)
+		return client.Update(ctx, o)
+	})
+	if err != nil {
+		return &APIError{Verb: "apply", Kind: o.GetKind(), Name: o.GetName(), Err: err}
+	}
+	return nil
+}
+
+// keepLiveMetadata carries what others added to a live object over to the
+// object replacing it: the annotations it does not set, e.g. the time of the
+// last key rotation, and the owner references unless it has its own.
+func keepLiveMetadata(o, live *unstructured.Unstructured) {
+	annotations := o.GetAnnotations()
+	for key, value := range live.GetAnnotations() {
+		if _, ok := annotations[key]; ok {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = value
+	}
+	o.SetAnnotations(annotations)
+	if len(o.GetOwnerReferences()) == 0 {
+		o.SetOwnerReferences(live.GetOwnerReferences())
+	}
+}
+
+// fail applies the failure policy and builds the *ApplyError.
+func (p *Provisioner) fail(
+	err error,
+	failed *unstructured.Unstructured,
+	result *Result,
+	pending []*unstructured.Unstructured,
+	options ApplyOptions) error {
+	applyErr := &ApplyError{
+		Err:     err,
+		Failed:  failed,
+		Created: result.Created,
+		Pending: pending,
+	}
+	if options.OnFailure == FailurePolicyKeep {
+		return applyErr
+	}
+
+	// The caller's context may be what failed, the rollback gets its own.
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	client := p.clients.GetControllerClient()
+	applyErr.Created = nil
+	for i := len(result.Created) - 1; i >= 0; i-- {
+		o := result.Created[i]
+		if isShared(o) {
+			applyErr.Kept = append([]*unstructured.Unstructured{o}, applyErr.Kept...)
+			continue
+		}
+		err := client.Delete(ctx, o)
+		if err != nil && !errors.IsNotFound(err) {
+			applyErr.RollbackErrors = append(applyErr.RollbackErrors,
+				&APIError{Verb: "delete", Kind: o.GetKind(), Name: o.GetName(), Err: err})
+			applyErr.Created = append([]*unstructured.Unstructured{o}, applyErr.Created...)
+			continue
+		}
+		glog.Infof("rolled back %q object %q", o.GetKind(), o.GetName())
+		applyErr.RolledBack = append(applyErr.RolledBack, o)
+	}
+	result.Created = applyErr.Created
+	return applyErr
+}
+
+// loadSSHKeys reads the member keys back from the Secrets of an earlier run.
+// A missing Secret is an *APIError that errors.IsNotFound recognizes. The
+// host keys of Secrets written before members had their own are empty.
+func (p *Provisioner) loadSSHKeys(
+	ctx context.Context,
+	spec ClusterSpec) (*sshKeys, error) {
+	client := p.clients.GetControllerClient()
+	keys := &sshKeys{
+		authorizedHosts: make([]byte, 0),
+		allPrivateKeys:  make([][]byte, 0),
+		allPublicKeys:   make([][]byte, 0),
+		hostPrivateKeys: make([][]byte, 0),
+		hostPublicKeys:  make([][]byte, 0),
+	}
+	for _, name := range memberNames(spec) {
+		secret := &coreV1.Secret{}
+		err := client.Get(ctx, types.NamespacedName{Namespace: spec.Namespace, Name: name}, secret)
+		if err != nil {
+			return nil, &APIError{Verb: "get", Kind: "Secret", Name: name, Err: err}
+		}
+		privateKey, publicKey := secret.Data["id_rsa"], secret.Data["id_rsa.pub"]
+		if len(privateKey) == 0 || len(publicKey) == 0 {
+			return nil, &KeyError{Err: fmt.Errorf("secret %q has no key pair", name)}
+		}
+		keys.authorizedHosts = append(keys.authorizedHosts, publicKey...)
+		keys.allPrivateKeys = append(keys.allPrivateKeys, privateKey)
+		keys.allPublicKeys = append(keys.allPublicKeys, publicKey)
+		keys.hostPrivateKeys = append(keys.hostPrivateKeys, secret.Data[hostKeyKey])
+		keys.hostPublicKeys = append(keys.hostPublicKeys, secret.Data[hostKeyKey+".pub"])
+	}
+	return keys, nil
+}
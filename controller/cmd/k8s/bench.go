@@ -0,0 +1,266 @@
+package k8s
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// DefaultBenchPairTimeout is the default BenchOptions.PairTimeout.
+const DefaultBenchPairTimeout = 2 * time.Minute
+
+// benchScript measures from the pod it runs in to the target member. The
+// latency samples are round trips of "ssh true" over one multiplexed
+// connection: they exclude the key exchange and the login, but include
+// opening a session channel and starting true on the target, so they are an
+// upper bound of the network round trip. The throughput is zeroes streamed
+// through an SSH channel into cat, encryption included. Only bash and ssh
+// are needed.
+const benchScript = `
+port=$1 target=$2 bytes=$3 samples=$4
+opts="$SSH_OPTIONS -l ${KSSH_LOGIN_USER:-$(id -un)} -o ControlMaster=auto -o ControlPath=/tmp/kssh-bench-%C -o ControlPersist=60"
+ssh $opts -p "$port" "$target" true < /dev/null || exit 1
+latencies=""
+for i in $(seq "$samples"); do
+  start=$(date +%s%N)
+  ssh $opts -p "$port" "$target" true < /dev/null || exit 1
+  end=$(date +%s%N)
+  latencies="$latencies $(( (end - start) / 1000 ))"
+done
+start=$(date +%s%N)
+head -c "$bytes" /dev/zero | ssh $opts -p "$port" "$target" 'cat > /dev/null' || exit 1
+end=$(date +%s%N)
+ssh $opts -p "$port" -O exit "$target" 2> /dev/null
+echo "latency_us$latencies"
+echo "transfer_ns $(( end - start ))"
+`
+
+// BenchOptions selects the pairs to measure and the size of the tests.
+type BenchOptions struct {
+	// Pairs are source and target member names. Empty means all pairs.
+	Pairs          [][2]string
+	Bytes          int64
+	LatencySamples int
+	// PairTimeout bounds the measurement of each pair, a failed pair does not
+	// stop the others. Zero means DefaultBenchPairTimeout.
+	PairTimeout time.Duration
+}
+
+func (o BenchOptions) pairTimeout() time.Duration {
+	if o.PairTimeout <= 0 {
+		return DefaultBenchPairTimeout
+	}
+	return o.PairTimeout
+}
+
+// BenchResult is the bandwidth and latency from Source to Target.
+type BenchResult struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// BytesPerSecond is the throughput of one SSH channel.
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	// Latency is the median time to run true on Target over an open SSH
+	// connection, which includes starting the command.
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// BenchReport holds the benchmark results and where each member runs.
+type BenchReport struct {
+	Members []string
+	Nodes   map[string]string
+	// Results is indexed by source and then by target member.
+	Results map[string]map[string]BenchResult
+}
+
+// Complete reports whether every measured pair succeeded.
+func (r *BenchReport) Complete() bool {
+	pairs := 0
+	for _, targets := range r.Results {
+		for _, result := range targets {
+			if result.Error != "" {
+				return false
+			}
+			pairs++
+		}
+	}
+	return pairs != 0
+}
+
+// BenchMesh measures the bandwidth and latency between members over the SSH
+// mesh. The pairs run one after another so they do not compete for the
+// network. Pairs naming an unknown member are a *ValidationError.
+func (p *Provisioner) BenchMesh(
+	ctx context.Context,
+	namespace string,
+	namePrefix string,
+	options BenchOptions) (*BenchReport, error) {
+	members, err := discoverMembers(ctx, p.clients, namespace, namePrefix)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]Member{}
+	report := &BenchReport{
+		Nodes:   map[string]string{},
+		Results: map[string]map[string]BenchResult{},
+	}
+	for _, member := range members {
+		byName[member.Name] = member
+		report.Members = append(report.Members, member.Name)
+		report.Results[member.Name] = map[string]BenchResult{}
+		if member.Pod != nil {
+			report.Nodes[member.Name] = member.Pod.Spec.NodeName
+		}
+	}
+
+	pairs := options.Pairs
+	if len(pairs) == 0 {
+		for _, source := range members {
+			for _, target := range members {
+				if source.Name != target.Name {
+					pairs = append(pairs, [2]string{source.Name, target.Name})
+				}
+			}
+		}
+	}
+	errs := field.ErrorList{}
+	for i, pair := range pairs {
+		for j, name := range pair {
+			if _, ok := byName[name]; !ok {
+				errs = append(errs, field.NotFound(field.NewPath("pairs").Index(i).Index(j), name))
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+	for _, pair := range pairs {
+		glog.Infof("benchmarking %s -> %s", pair[0], pair[1])
+		pairCtx, cancel := context.WithTimeout(ctx, options.pairTimeout())
+		report.Results[pair[0]][pair[1]] = benchFrom(pairCtx, p.clients, byName[pair[0]], pair[1], options)
+		cancel()
+	}
+	return report, nil
+}
+
+// benchFrom runs benchScript in the pod of source.
+func benchFrom(
+	ctx context.Context,
+	clients Clients,
+	source Member,
+	target string,
+	options BenchOptions) BenchResult {
+	result := BenchResult{Source: source.Name, Target: target}
+	if source.Pod == nil {
+		result.Error = "source has no ready pod"
+		return result
+	}
+	command := []string{
+		"env", "SSH_OPTIONS=" + strings.Join(sshOptions, " "),
+		"bash", "-c", benchScript, "bench",
+		strconv.Itoa(memberPort(source.Pod)), target,
+		strconv.FormatInt(options.Bytes, 10), strconv.Itoa(options.LatencySamples),
+	}
+	stdout, stderr, err := execInPod(ctx, clients, source.Pod, source.Name, command, nil)
+	if err != nil {
+		result.Error = fmt.Sprintf("%v %s", err, strings.TrimSpace(stderr))
+		return result
+	}
+	return parseBenchOutput(result, options.Bytes, stdout)
+}
+
+func parseBenchOutput(result BenchResult, bytes int64, stdout string) BenchResult {
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "latency_us":
+			var samples []time.Duration
+			for _, field := range fields[1:] {
+				if us, err := strconv.ParseInt(field, 10, 64); err == nil {
+					samples = append(samples, time.Duration(us)*time.Microsecond)
+				}
+			}
+			if len(samples) != 0 {
+				sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+				result.Latency = samples[len(samples)/2]
+			}
+		case "transfer_ns":
+			if len(fields) == 2 {
+				if ns, err := strconv.ParseInt(fields[1], 10, 64); err == nil && ns > 0 {
+					result.BytesPerSecond = float64(bytes) / time.Duration(ns).Seconds()
+				}
+			}
+		}
+	}
+	if result.BytesPerSecond == 0 {
+		result.Error = "no throughput measured"
+	}
+	return result
+}
+
+// PrintBench writes the node of every member, then the bandwidth and the
+// median latency matrices with sources as rows and targets as columns.
+func PrintBench(w io.Writer, report *BenchReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MEMBER\tNODE")
+	for _, member := range report.Members {
+		fmt.Fprintf(tw, "%s\t%s\n", member, orNone(report.Nodes[member]))
+	}
+	matrices := []struct {
+		title string
+		cell  func(BenchResult) string
+	}{
+		{"BANDWIDTH (Mbit/s)", func(r BenchResult) string {
+			return strconv.FormatFloat(r.BytesPerSecond*8/1e6, 'f', 1, 64)
+		}},
+		{"LATENCY (median)", func(r BenchResult) string {
+			return r.Latency.Round(10 * time.Microsecond).String()
+		}},
+	}
+	var failures []BenchResult
+	for i, matrix := range matrices {
+		fmt.Fprintf(tw, "\n%s", matrix.title)
+		for _, target := range report.Members {
+			fmt.Fprintf(tw, "\t%s", target)
+		}
+		fmt.Fprintln(tw)
+		for _, source := range report.Members {
+			fmt.Fprint(tw, source)
+			for _, target := range report.Members {
+				result, ok := report.Results[source][target]
+				switch {
+				case !ok:
+					fmt.Fprint(tw, "\t-")
+				case result.Error != "":
+					fmt.Fprint(tw, "\tFAIL")
+					if i == 0 {
+						failures = append(failures, result)
+					}
+				default:
+					fmt.Fprintf(tw, "\t%s", matrix.cell(result))
+				}
+			}
+			fmt.Fprintln(tw)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, failure := range failures {
+		fmt.Fprintf(w, "%s -> %s: %s\n", failure.Source, failure.Target, failure.Error)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	appsV1 "k8s.io/api/apps/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	ctrlFake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestBenchReport(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	result := parseBenchOutput(
+		BenchResult{Source: "sample-0", Target: "sample-1"},
+		100<<20,
+		"latency_us 900 300 500\ntransfer_ns 1000000000\n")
+	g.Expect(result.Error).To(gomega.BeEmpty())
+	g.Expect(result.Latency).To(gomega.Equal(500 * time.Microsecond))
+	g.Expect(result.BytesPerSecond).To(gomega.Equal(float64(100 << 20)))
+
+	report := &BenchReport{
+		Members: []string{"sample-0", "sample-1"},
+		Nodes:   map[string]string{"sample-0": "node-a"},
+		Results: map[string]map[string]BenchResult{
+			"sample-0": {"sample-1": result},
+			"sample-1": {"sample-0": parseBenchOutput(BenchResult{Source: "sample-1", Target: "sample-0"}, 1, "")},
+		},
+	}
+	g.Expect(report.Complete()).To(gomega.BeFalse())
+	var buf bytes.Buffer
+	g.Expect(PrintBench(&buf, report)).To(gomega.Succeed())
+	g.Expect(buf.String()).To(gomega.ContainSubstring("node-a"))
+	g.Expect(buf.String()).To(gomega.ContainSubstring("838.9"))
+	g.Expect(buf.String()).To(gomega.ContainSubstring("sample-1 -> sample-0: no throughput measured"))
+
+	delete(report.Results["sample-1"], "sample-0")
+	g.Expect(report.Complete()).To(gomega.BeTrue())
+}
+
+func TestBenchMeshUnknownPair(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	deploy := &appsV1.Deployment{ObjectMeta: metaV1.ObjectMeta{
+		Namespace: "ns", Name: "sample-0", Labels: map[string]string{clusterLabel: "sample"},
+	}}
+	clients := NewClients(nil, fake.NewSimpleClientset(deploy), ctrlFake.NewClientBuilder().Build())
+	_, err := NewProvisioner(clients).BenchMesh(context.Background(), "ns", "sample", BenchOptions{
+		Pairs: [][2]string{{"sample-0", "sample-9"}},
+	})
+	var validationErr *ValidationError
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Errors).To(gomega.HaveLen(1))
+	g.Expect(validationErr.Errors[0].Field).To(gomega.Equal("pairs[0][1]"))
+	g.Expect(errors.Is(err, ErrNoMembers)).To(gomega.BeFalse())
+}
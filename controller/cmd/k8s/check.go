@@ -0,0 +1,262 @@
+package k8s
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	checkConnectTimeoutSeconds = 5
+	checkTimeout               = 5 * time.Minute
+)
+
+// sshOptions make the in-cluster ssh non-interactive and ignore host keys,
+// the members trust each other through authorized_keys only.
+var sshOptions = []string{
+	"-o", "BatchMode=yes",
+	"-o", fmt.Sprintf("ConnectTimeout=%d", checkConnectTimeoutSeconds),
+	"-o", "StrictHostKeyChecking=no",
+	"-o", "UserKnownHostsFile=/dev/null",
+	"-o", "LogLevel=ERROR",
+}
+
+// checkScript logs in, as KSSH_LOGIN_USER of the pod it runs in or else as
+// the account the pod runs as, to every target given as an argument and prints
+// "<target>\t<exit code>\t<milliseconds>\t<error>".
+const checkScript = `
+port=$1
+shift
+for target in "$@"; do
+  start=$(date +%s%N)
+  out=$(ssh $SSH_OPTIONS -l "${KSSH_LOGIN_USER:-$(id -un)}" -p "$port" "$target" true 2>&1 < /dev/null)
+  rc=$?
+  end=$(date +%s%N)
+  printf '%s\t%s\t%s\t%s\n' "$target" "$rc" "$(( (end - start) / 1000000 ))" "$(echo $out | tr '\t\n' '  ')"
+done
+`
+
+// Member is a cluster member and its ready pod, if any.
+type Member struct {
+	Name string
+	Pod  *coreV1.Pod
+}
+
+// PairResult is the outcome of one SSH login from Source to Target.
+type PairResult struct {
+	Source  string        `json:"source"`
+	Target  string        `json:"target"`
+	OK      bool          `json:"ok"`
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// MeshReport holds the results of the all-pairs connectivity check.
+type MeshReport struct {
+	Members []string
+	// Results is indexed by source and then by target member.
+	Results map[string]map[string]PairResult
+}
+
+// Complete reports whether every member can log in to every other member.
+func (r *MeshReport) Complete() bool {
+	for _, source := range r.Members {
+		for _, target := range r.Members {
+			if source != target && !r.Results[source][target].OK {
+				return false
+			}
+		}
+	}
+	return len(r.Members) != 0
+}
+
+// discoverMembers finds the members of a cluster from its Deployments and
+// pairs each of them with a ready pod.
+func discoverMembers(
+	ctx context.Context,
+	clients Clients,
+	namespace string,
+	namePrefix string) ([]Member, error) {
+	cs := clients.GetClientSet()
+	options := metaV1.ListOptions{LabelSelector: statusSelector(namePrefix)}
+	deploys, err := cs.AppsV1().Deployments(namespace).List(ctx, options)
+	if err != nil {
+		return nil, &APIError{Verb: "list", Kind: "Deployment", Err: err}
+	}
+	if len(deploys.Items) == 0 {
+		return nil, fmt.Errorf("%w: %q in namespace %q", ErrNoMembers, namePrefix, namespace)
+	}
+	pods, err := cs.CoreV1().Pods(namespace).List(ctx, options)
+	if err != nil {
+		return nil, &APIError{Verb: "list", Kind: "Pod", Err: err}
+	}
+	podMap := map[string]*coreV1.Pod{}
+	for i := range pods.Items {
+		podMap[pods.Items[i].Name] = &pods.Items[i]
+	}
+	byMember := podsByMember(podMap)
+
+	members := make([]Member, 0, len(deploys.Items))
+	for _, deploy := range deploys.Items {
+		members = append(members, Member{
+			Name: deploy.Name,
+			Pod:  readyPod(byMember[deploy.Name]),
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return memberLess(members[i].Name, members[j].Name)
+	})
+	return members, nil
+}
+
+// CheckMesh logs in from every member to every other member by its Service
+// name and reports success, latency and errors for each pair.
+func (p *Provisioner) CheckMesh(
+	ctx context.Context,
+	namespace string,
+	namePrefix string) (*MeshReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	members, err := discoverMembers(ctx, p.clients, namespace, namePrefix)
+	if err != nil {
+		return nil, err
+	}
+	report := &MeshReport{Results: map[string]map[string]PairResult{}}
+	for _, member := range members {
+		report.Members = append(report.Members, member.Name)
+		report.Results[member.Name] = map[string]PairResult{}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, source := range members {
+		targets := []string{}
+		for _, target := range members {
+			if target.Name != source.Name {
+				targets = append(targets, target.Name)
+			}
+		}
+		wg.Add(1)
+		go func(source Member) {
+			defer wg.Done()
+			results := checkFrom(ctx, p.clients, source, targets)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, result := range results {
+				report.Results[source.Name][result.Target] = result
+			}
+		}(source)
+	}
+	wg.Wait()
+	return report, nil
+}
+
+// memberPort returns the port sshd of a member listens on, which every
+// member shares.
+func memberPort(pod *coreV1.Pod) int {
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			return int(port.ContainerPort)
+		}
+	}
+	return appPort
+}
+
+// checkFrom runs checkScript in the pod of source.
+func checkFrom(
+	ctx context.Context,
+	clients Clients,
+	source Member,
+	targets []string) []PairResult {
+	failAll := func(reason string) []PairResult {
+		results := []PairResult{}
+		for _, target := range targets {
+			results = append(results, PairResult{Source: source.Name, Target: target, Error: reason})
+		}
+		return results
+	}
+	if source.Pod == nil {
+		return failAll("source has no ready pod")
+	}
+	command := append([]string{
+		"env", "SSH_OPTIONS=" + strings.Join(sshOptions, " "),
+		"bash", "-c", checkScript, "check", strconv.Itoa(memberPort(source.Pod)),
+	}, targets...)
+	stdout, stderr, err := execInPod(ctx, clients, source.Pod, source.Name, command, nil)
+	if err != nil {
+		return failAll(fmt.Sprintf("exec failed: %v %s", err, strings.TrimSpace(stderr)))
+	}
+	return parseCheckOutput(source.Name, stdout)
+}
+
+func parseCheckOutput(source string, stdout string) []PairResult {
+	results := []PairResult{}
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		result := PairResult{Source: source, Target: fields[0], OK: fields[1] == "0"}
+		if ms, err := strconv.Atoi(fields[2]); err == nil {
+			result.Latency = time.Duration(ms) * time.Millisecond
+		}
+		if !result.OK {
+			result.Error = strings.TrimSpace(fields[3])
+			if result.Error == "" {
+				result.Error = "ssh exited with " + fields[1]
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// PrintMesh writes the N×N matrix, sources as rows and targets as columns,
+// followed by the error of each failing pair.
+func PrintMesh(w io.Writer, report *MeshReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprint(tw, "FROM \\ TO")
+	for _, target := range report.Members {
+		fmt.Fprintf(tw, "\t%s", target)
+	}
+	fmt.Fprintln(tw)
+	var failures []PairResult
+	for _, source := range report.Members {
+		fmt.Fprint(tw, source)
+		for _, target := range report.Members {
+			result, ok := report.Results[source][target]
+			switch {
+			case source == target:
+				fmt.Fprint(tw, "\t-")
+			case !ok:
+				fmt.Fprint(tw, "\tFAIL")
+				failures = append(failures, PairResult{Source: source, Target: target, Error: "not checked"})
+			case result.OK:
+				fmt.Fprintf(tw, "\tok %v", result.Latency)
+			default:
+				fmt.Fprint(tw, "\tFAIL")
+				failures = append(failures, result)
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, failure := range failures {
+		fmt.Fprintf(w, "%s -> %s: %s\n", failure.Source, failure.Target, failure.Error)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package k8s
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+)
+
+func TestMeshReport(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	report := &MeshReport{
+		Members: []string{"sample-0", "sample-1"},
+		Results: map[string]map[string]PairResult{
+			"sample-0": {},
+			"sample-1": {},
+		},
+	}
+	for _, result := range parseCheckOutput("sample-0", "sample-1\t0\t12\t\n") {
+		report.Results["sample-0"][result.Target] = result
+	}
+	for _, result := range parseCheckOutput("sample-1", "sample-0\t255\t5003\tPermission denied (publickey).\n") {
+		report.Results["sample-1"][result.Target] = result
+	}
+	g.Expect(report.Results["sample-0"]["sample-1"].Latency).To(gomega.Equal(12 * time.Millisecond))
+	g.Expect(report.Complete()).To(gomega.BeFalse())
+
+	var buf bytes.Buffer
+	g.Expect(PrintMesh(&buf, report)).To(gomega.Succeed())
+	g.Expect(buf.String()).To(gomega.ContainSubstring("ok 12ms"))
+	g.Expect(buf.String()).To(gomega.ContainSubstring("sample-1 -> sample-0: Permission denied (publickey)."))
+
+	report.Results["sample-1"]["sample-0"] = PairResult{OK: true}
+	g.Expect(report.Complete()).To(gomega.BeTrue())
+}
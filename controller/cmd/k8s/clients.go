@@ -1,40 +1,116 @@
 package k8s
 
 import (
-	"github.com/golang/glog"
+	"fmt"
+
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	ctrl "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Clients struct {
-	clientSet        *kubernetes.Clientset
+	config           *rest.Config
+	clientSet        kubernetes.Interface
 	controllerClient ctrl.Client
 }
 
-func New(kubeconfigPath string) Clients {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+// ClientOptions selects the cluster and credentials like kubectl does. With
+// an empty Kubeconfig the standard loading rules apply: the files listed in
+// $KUBECONFIG, then ~/.kube/config, then the service account of the pod when
+// running in a cluster.
+type ClientOptions struct {
+	Kubeconfig string
+	// Context, User and Cluster override the current context and its parts.
+	Context string
+	User    string
+	Cluster string
+	// Impersonate and ImpersonateGroups act as another user, like --as and
+	// --as-group.
+	Impersonate       string
+	ImpersonateGroups []string
+	// QPS and Burst tune the client-side rate limiter. Zero values keep the
+	// client-go defaults of 5 QPS and a burst of 10, which throttle large
+	// deploys long before the API server does.
+	QPS   float32
+	Burst int
+}
+
+func New(options ClientOptions) (Clients, error) {
+	config, err := LoadConfig(options)
 	if err != nil {
-		glog.Fatalf("fail to build k8s config: %v", err)
+		return Clients{}, err
+	}
+	return NewForConfig(config)
+}
+
+// LoadConfig builds the rest config selected by the options.
+func LoadConfig(options ClientOptions) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = options.Kubeconfig
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: options.Context,
+		Context: clientcmdapi.Context{
+			AuthInfo: options.User,
+			Cluster:  options.Cluster,
+		},
+	}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("fail to build k8s config: %w", err)
+	}
+	// Impersonation is set here rather than in the overrides, which would
+	// keep the in-cluster config from being used.
+	if options.Impersonate != "" || len(options.ImpersonateGroups) != 0 {
+		config.Impersonate = rest.ImpersonationConfig{
+			UserName: options.Impersonate,
+			Groups:   options.ImpersonateGroups,
+		}
 	}
+	if options.QPS > 0 {
+		config.QPS = options.QPS
+	}
+	if options.Burst > 0 {
+		config.Burst = options.Burst
+	}
+	return config, nil
+}
+
+// NewForConfig builds the clients from a rest config.
+func NewForConfig(config *rest.Config) (Clients, error) {
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		glog.Fatalf("fail to build k8s client set: %v", err)
+		return Clients{}, fmt.Errorf("fail to build k8s client set: %w", err)
 	}
 	controllerClient, err := ctrl.New(config, ctrl.Options{})
 	if err != nil {
-		glog.Fatalf("fail to build k8s controller client: %v", err)
+		return Clients{}, fmt.Errorf("fail to build k8s controller client: %w", err)
 	}
+	return NewClients(config, clientset, controllerClient), nil
+}
+
+// NewClients wraps existing clients, e.g. fakes in tests. The rest config is
+// only needed to exec into pods and may be nil otherwise.
+func NewClients(
+	config *rest.Config,
+	clientSet kubernetes.Interface,
+	controllerClient ctrl.Client) Clients {
 	return Clients{
-		clientSet:        clientset,
+		config:           config,
+		clientSet:        clientSet,
 		controllerClient: controllerClient,
 	}
 }
 
-func (c *Clients) GetClientSet() *kubernetes.Clientset {
+func (c *Clients) GetClientSet() kubernetes.Interface {
 	return c.clientSet
 }
 
 func (c *Clients) GetControllerClient() ctrl.Client {
 	return c.controllerClient
 }
+
+func (c *Clients) GetRestConfig() *rest.Config {
+	return c.config
+}
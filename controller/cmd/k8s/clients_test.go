@@ -0,0 +1,86 @@
+package k8s
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+const testKubeconfig = `
+apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com
+- name: prod
+  cluster:
+    server: https://prod.example.com
+users:
+- name: alice
+  user:
+    token: alice-token
+- name: bob
+  user:
+    token: bob-token
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: alice
+- name: prod
+  context:
+    cluster: prod
+    user: bob
+`
+
+func TestLoadConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	g.Expect(os.WriteFile(path, []byte(testKubeconfig), 0600)).To(gomega.Succeed())
+
+	config, err := LoadConfig(ClientOptions{Kubeconfig: path})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(config.Host).To(gomega.Equal("https://dev.example.com"))
+	g.Expect(config.BearerToken).To(gomega.Equal("alice-token"))
+
+	config, err = LoadConfig(ClientOptions{Kubeconfig: path, Context: "prod", User: "alice"})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(config.Host).To(gomega.Equal("https://prod.example.com"))
+	g.Expect(config.BearerToken).To(gomega.Equal("alice-token"))
+
+	config, err = LoadConfig(ClientOptions{
+		Kubeconfig:        path,
+		Cluster:           "prod",
+		Impersonate:       "carol",
+		ImpersonateGroups: []string{"admins"},
+		QPS:               50,
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(config.Host).To(gomega.Equal("https://prod.example.com"))
+	g.Expect(config.Impersonate.UserName).To(gomega.Equal("carol"))
+	g.Expect(config.Impersonate.Groups).To(gomega.Equal([]string{"admins"}))
+	g.Expect(config.QPS).To(gomega.Equal(float32(50)))
+
+	_, err = LoadConfig(ClientOptions{Kubeconfig: path, Context: "missing"})
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestLoadConfigKubeconfigList(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	g.Expect(os.WriteFile(first, []byte("apiVersion: v1\nkind: Config\ncurrent-context: prod\n"), 0600)).To(gomega.Succeed())
+	g.Expect(os.WriteFile(second, []byte(testKubeconfig), 0600)).To(gomega.Succeed())
+	t.Setenv("KUBECONFIG", first+string(filepath.ListSeparator)+second)
+
+	// The first file sets the current context, the second defines it.
+	config, err := LoadConfig(ClientOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(config.Host).To(gomega.Equal("https://prod.example.com"))
+}
@@ -30,13 +30,16 @@ const (
 )
 
 func DeployK8sObjects(
-	cs *kubernetes.Clientset,
+	ctx context.Context,
+	cs kubernetes.Interface,
 	namespace string,
 	namePrefix string,
-	podNum int) {
-	objs := buildK8sObjects(namespace, namePrefix, podNum)
-	ctx := context.Background()
-	_, err := cs.CoreV1().Namespaces().Get(ctx, namespace, metaV1.GetOptions{})
+	podNum int) error {
+	objs, err := buildK8sObjects(namespace, namePrefix, podNum)
+	if err != nil {
+		return err
+	}
+	_, err = cs.CoreV1().Namespaces().Get(ctx, namespace, metaV1.GetOptions{})
 	if errors.IsNotFound(err) {
 		v1Namespace := &coreV1.Namespace{
 			ObjectMeta: metaV1.ObjectMeta{
@@ -45,21 +48,21 @@ func DeployK8sObjects(
 		}
 		if _, err := cs.CoreV1().Namespaces().
 			Create(ctx, v1Namespace, metaV1.CreateOptions{}); err != nil {
-			glog.Fatalf("failed to create namespace: %v", err)
+			return &APIError{Verb: "create", Kind: "Namespace", Name: namespace, Err: err}
 		}
 	} else if err != nil {
-		glog.Fatalf("failed to create namespace: %v", err)
+		return &APIError{Verb: "get", Kind: "Namespace", Name: namespace, Err: err}
 	}
 	for _, deploy := range objs.deployList {
 		_, err := cs.AppsV1().Deployments(namespace).Get(ctx, deploy.Name, metaV1.GetOptions{})
 		if errors.IsNotFound(err) {
 			if _, err := cs.AppsV1().Deployments(namespace).
 				Create(ctx, deploy, metaV1.CreateOptions{}); err != nil {
-				glog.Fatalf("failed to create deployment %q: %v", deploy.Name, err)
+				return &APIError{Verb: "create", Kind: "Deployment", Name: deploy.Name, Err: err}
 			}
 			glog.Infof("Deployment %q deployed.", deploy.Name)
 		} else if err != nil {
-			glog.Fatalf("failed to get deployment %q: %v", deploy.Name, err)
+			return &APIError{Verb: "get", Kind: "Deployment", Name: deploy.Name, Err: err}
 		}
 	}
 
@@ -68,11 +71,11 @@ func DeployK8sObjects(
 		if errors.IsNotFound(err) {
 			if _, err := cs.CoreV1().Services(namespace).
 				Create(ctx, svc, metaV1.CreateOptions{}); err != nil {
-				glog.Fatalf("failed to create service %q: %v", svc.Name, err)
+				return &APIError{Verb: "create", Kind: "Service", Name: svc.Name, Err: err}
 			}
 			glog.Infof("Service %q deployed.", svc.Name)
 		} else if err != nil {
-			glog.Fatalf("failed to get service %q: %v", svc.Name, err)
+			return &APIError{Verb: "get", Kind: "Service", Name: svc.Name, Err: err}
 		}
 	}
 
@@ -81,11 +84,11 @@ func DeployK8sObjects(
 		if errors.IsNotFound(err) {
 			if _, err := cs.CoreV1().Secrets(namespace).
 				Create(ctx, secret, metaV1.CreateOptions{}); err != nil {
-				glog.Fatalf("failed to create secret %q: %v", secret.Name, err)
+				return &APIError{Verb: "create", Kind: "Secret", Name: secret.Name, Err: err}
 			}
 			glog.Infof("Secret %q deployed.", secret.Name)
 		} else if err != nil {
-			glog.Fatalf("failed to get secret %q: %v", secret.Name, err)
+			return &APIError{Verb: "get", Kind: "Secret", Name: secret.Name, Err: err}
 		}
 	}
 
@@ -94,13 +97,14 @@ func DeployK8sObjects(
 		if errors.IsNotFound(err) {
 			if _, err := cs.CoreV1().ConfigMaps(namespace).
 				Create(ctx, configMap, metaV1.CreateOptions{}); err != nil {
-				glog.Fatalf("failed to create configMap %q: %v", configMap.Name, err)
+				return &APIError{Verb: "create", Kind: "ConfigMap", Name: configMap.Name, Err: err}
 			}
 			glog.Infof("ConfigMap %q deployed.", configMap.Name)
 		} else if err != nil {
-			glog.Fatalf("failed to get configMap %q: %v", configMap.Name, err)
+			return &APIError{Verb: "get", Kind: "ConfigMap", Name: configMap.Name, Err: err}
 		}
 	}
+	return nil
 }
 
 type buildK8sObjectsResponse struct {
@@ -113,7 +117,7 @@ type buildK8sObjectsResponse struct {
 func buildK8sObjects(
 	namespace string,
 	namePrefix string,
-	podNum int) buildK8sObjectsResponse {
+	podNum int) (buildK8sObjectsResponse, error) {
 	response := buildK8sObjectsResponse{}
 
 	authorizedHosts := []byte{}
@@ -122,7 +126,10 @@ func buildK8sObjects(
 		response.deployList = append(response.deployList, createDeployment(namespace, name))
 		response.svcList = append(response.svcList, createService(namespace, name))
 
-		privateKey, publicKey := generateSSHKey()
+		privateKey, publicKey, err := generateSSHKey()
+		if err != nil {
+			return response, err
+		}
 		authorizedHosts = append(authorizedHosts, publicKey...)
 		response.secretList = append(response.secretList, createSecret(namespace, name, privateKey, publicKey))
 	}
@@ -130,7 +137,7 @@ func buildK8sObjects(
 		secret.Data["authorized_keys"] = authorizedHosts
 	}
 	response.configMapList = createConfigMaps(namespace)
-	return response
+	return response, nil
 }
 
 func createDeployment(
@@ -1,153 +1,357 @@
 package k8s
 
 import (
-	"bytes"
 	"context"
-	_ "embed"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"strings"
-	"text/template"
 
 	"github.com/golang/glog"
-	"github.com/zicongmei/kubernetes-ssh/controller/cmd/k8s/yamlDecoder"
+	rbacV1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/workqueue"
 )
 
-//go:embed templates/pod-bootstrapt.sh
-var bootstraptContent string
-
-//go:embed templates/systemObjs.yaml
-var systemTmpl string
-
-//go:embed templates/podObjs.yaml
-var perPodTaml string
-
 const (
 	bootstraptKey = "bootstrapt.sh"
 )
 
+// TemplateData is what the templates are executed with. Fields that only
+// make sense for one member are empty in systemObjs.yaml and clusterObjs.yaml.
 type TemplateData struct {
-	Namespace               string
-	Name                    string
+	// Spec is the whole cluster spec, for templates that need more than the
+	// fields below.
+	Spec       ClusterSpec
+	Namespace  string
+	NamePrefix string
+	PodNum     int
+	// Members are the names of all members.
+	Members []string
+	// Labels are the labels of the object being rendered, those of a member
+	// for podObjs.yaml. The templates add app.kubernetes.io/component.
+	Labels map[string]string
+	// AnchorName is the ConfigMap that owns the cluster, AnchorSpec the spec
+	// it was deployed with.
+	AnchorName string
+	AnchorSpec string
+	// Name and Index identify the member being rendered.
+	Name  string
+	Index int
+	// BootstraptConfigMapName is the shared ConfigMap holding the bootstrap
+	// script, BootstraptScript, named after its content.
 	BootstraptConfigMapName string
-	BootstraptContent       string
-	Image                   string
-	Port                    int
-	AuthorizedKeys          string
-	SSHPrivateKey           string
-	SSHPublicKey            string
+	BootstraptScript        string
+	// UsersConfigMapName holds the keys of spec.Users, UserAuthorizedKeys,
+	// as its UsersKeysFile. sshd reads them as UsersKeysPath.
+	UsersConfigMapName string
+	UsersKeysFile      string
+	UsersKeysPath      string
+	UserAuthorizedKeys string
+	// RevokedConfigMapName holds RevokedKeys, the keys sshd refuses, which
+	// the members mount at RevokedKeysPath.
+	RevokedConfigMapName string
+	RevokedKeysPath      string
+	RevokedKeys          string
+	// LoginUsers are created by LoginUsersScript when the sshd container
+	// starts. LoginUser is the account the members log in to each other as.
+	LoginUsers       []LoginUserSpec
+	LoginUsersScript string
+	LoginUser        string
+	// Restricted runs the members as RunAsUser, whose home is Home, under
+	// the restricted Pod Security Standard.
+	Restricted     bool
+	RunAsUser      int64
+	Home           string
+	Image          string
+	Port           int
+	AuthorizedKeys string
+	SSHPrivateKey  string
+	SSHPublicKey   string
+	// SSHHostKey is the key sshd identifies the member with.
+	SSHHostKey                string
+	SSHHostPublicKey          string
+	PersistentHome            bool
+	HomeSize                  string
+	StorageClassName          string
+	NetworkPolicy             bool
+	AllowedCIDRs              []string
+	AllowedNamespaces         []string
+	ProbePeriodSeconds        int
+	ProbeTimeoutSeconds       int
+	StartupFailureThreshold   int
+	ReadinessFailureThreshold int
+	LivenessFailureThreshold  int
+	// The Controller fields are only set for installObjs.yaml. A Role
+	// grants ControllerRules, a ClusterRole ControllerClusterRules.
+	ControllerName         string
+	ControllerImage        string
+	ControllerSpec         string
+	ControllerSpecDir      string
+	ControllerRules        []rbacV1.PolicyRule
+	ControllerClusterRules []rbacV1.PolicyRule
+}
+
+// newTemplateData fills in the fields shared by every template.
+func newTemplateData(spec ClusterSpec) TemplateData {
+	return TemplateData{
+		Spec:                      spec,
+		Namespace:                 spec.Namespace,
+		NamePrefix:                spec.NamePrefix,
+		PodNum:                    spec.PodNum,
+		Members:                   memberNames(spec),
+		Labels:                    clusterLabels(spec),
+		AnchorName:                anchorName(spec),
+		UsersConfigMapName:        usersConfigMapName(spec),
+		UsersKeysPath:             usersKeysPath(spec),
+		RevokedConfigMapName:      revokedConfigMapName(spec),
+		RevokedKeysPath:           revokedKeysPath,
+		LoginUsers:                spec.LoginUsers,
+		LoginUser:                 spec.loginUser(),
+		Image:                     spec.image(),
+		Port:                      spec.PodSecurity.port(),
+		Restricted:                spec.PodSecurity.Restricted,
+		RunAsUser:                 spec.PodSecurity.runAsUser(),
+		Home:                      spec.PodSecurity.home(),
+		PersistentHome:            spec.Persistence.Enabled,
+		HomeSize:                  spec.Persistence.Size,
+		StorageClassName:          spec.Persistence.StorageClassName,
+		NetworkPolicy:             spec.NetworkPolicy.Enabled,
+		AllowedCIDRs:              spec.NetworkPolicy.AllowedCIDRs,
+		AllowedNamespaces:         spec.NetworkPolicy.AllowedNamespaces,
+		ProbePeriodSeconds:        spec.Probe.PeriodSeconds,
+		ProbeTimeoutSeconds:       spec.Probe.TimeoutSeconds,
+		StartupFailureThreshold:   spec.Probe.StartupFailureThreshold,
+		ReadinessFailureThreshold: spec.Probe.ReadinessFailureThreshold,
+		LivenessFailureThreshold:  spec.Probe.LivenessFailureThreshold,
+	}
 }
 
-func DeployYaml(
-	clients Clients,
-	namespace string,
-	namePrefix string,
-	podNum int) {
-	ctx := context.Background()
-	client := clients.GetControllerClient()
-
-	allObjs := generateObjs(namespace, namePrefix, podNum)
-	for _, o := range allObjs {
-		err := client.Create(ctx, o)
+// Delete removes the per-member objects of a cluster. The namespace and the
+// shared bootstrap ConfigMap are left alone, and the member PVCs are only
+// deleted when the retention policy asks for it, also when the spec no
+// longer enables persistence.
+func (p *Provisioner) Delete(
+	ctx context.Context,
+	spec ClusterSpec) error {
+	client := p.clients.GetControllerClient()
+
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	// Render the PVCs to delete them, an earlier deploy may have created
+	// them.
+	podSpec := spec
+	if spec.Persistence.RetentionPolicy == RetentionPolicyDelete {
+		podSpec.Persistence.Enabled = true
+	}
+	// Only names matter here, so there is no need to generate real keys.
+	objs, err := renderAllPods(podSpec, emptySSHKeys(spec.PodNum))
+	if err != nil {
+		return err
+	}
+	// Always try to remove the NetworkPolicy, it may have been created by an
+	// earlier deploy that had it enabled.
+	policySpec := spec
+	policySpec.NetworkPolicy.Enabled = true
+	clusterObjs, err := generateClusterObjs(policySpec)
+	if err != nil {
+		return err
+	}
+	usersObjs, err := generateUsersObjs(spec, nil, nil)
+	if err != nil {
+		return err
+	}
+	objs = append(append(clusterObjs, usersObjs...), objs...)
+	for i := len(objs) - 1; i >= 0; i-- {
+		o := objs[i]
+		if o.GetKind() == "PersistentVolumeClaim" &&
+			spec.Persistence.RetentionPolicy != RetentionPolicyDelete {
+			glog.Infof("kept %q object %q", o.GetKind(), o.GetName())
+			continue
+		}
+		err := client.Delete(ctx, o)
+		if errors.IsNotFound(err) {
+			continue
+		}
 		if err != nil {
-			glog.Fatalf("failed to create %q object %q: %v", o.GetKind(), o.GetName(), err)
+			return &APIError{Verb: "delete", Kind: o.GetKind(), Name: o.GetName(), Err: err}
 		}
-		glog.Infof("created %q object %q", o.GetKind(), o.GetName())
+		glog.Infof("deleted %q object %q", o.GetKind(), o.GetName())
 	}
+	return nil
 }
 
+// generateObjs renders every object of the cluster with the given keys.
 func generateObjs(
-	namespace string,
-	namePrefix string,
-	podNum int) []*unstructured.Unstructured {
-	systemObjs := generateSystemObjs(namespace)
-	podObjs := generateAllPods(namespace, namePrefix, podNum)
-	return append(systemObjs, podObjs...)
-}
-
-func generateSystemObjs(namespace string) []*unstructured.Unstructured {
-	data := TemplateData{
-		Namespace:               namespace,
-		BootstraptContent:       strings.Join(strings.Split(bootstraptContent, "\n"), `\n`),
-		BootstraptConfigMapName: bootstraptKey,
+	spec ClusterSpec,
+	keys *sshKeys) ([]*unstructured.Unstructured, error) {
+	systemObjs, err := generateSystemObjs(spec)
+	if err != nil {
+		return nil, err
+	}
+	clusterObjs, err := generateClusterObjs(spec)
+	if err != nil {
+		return nil, err
 	}
-	tmpl, err := template.New("tmpl").Parse(systemTmpl)
+	usersObjs, err := generateUsersObjs(spec, keys.userKeys, keys.revokedKeys)
 	if err != nil {
-		glog.Fatalf("failed to parse system template: %v", err)
+		return nil, err
 	}
-	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, data)
+	podObjs, err := renderAllPods(spec, keys)
 	if err != nil {
-		glog.Fatalf("failed to execute system template: %v", err)
+		return nil, err
 	}
-	fmt.Println(buf.String())
-	objs, err := yamlDecoder.Decode(buf.String())
+	return append(append(append(systemObjs, clusterObjs...), usersObjs...), podObjs...), nil
+}
+
+func generateSystemObjs(spec ClusterSpec) ([]*unstructured.Unstructured, error) {
+	script, _, err := readTemplate(spec.TemplatesDir, bootstraptTemplate)
+	if err != nil {
+		return nil, err
+	}
+	data := newTemplateData(spec)
+	data.BootstraptConfigMapName = bootstraptConfigMapName(script)
+	data.BootstraptScript = script
+	return renderTemplate(spec.TemplatesDir, systemTemplate, data)
+}
+
+// bootstraptConfigMapName names the shared ConfigMap holding script after
+// its content. Clusters running the same script share it, while a changed
+// script gets its own rather than being ignored or changing the script of
+// the clusters already running.
+func bootstraptConfigMapName(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return "bootstrapt-" + hex.EncodeToString(sum[:5])
+}
+
+func generateClusterObjs(spec ClusterSpec) ([]*unstructured.Unstructured, error) {
+	anchorSpec, err := MarshalClusterSpec(spec)
 	if err != nil {
-		glog.Fatalf("failed to decode the system yaml: %v", err)
+		return nil, err
 	}
-	return objs
+	data := newTemplateData(spec)
+	data.AnchorSpec = string(anchorSpec)
+	return renderTemplate(spec.TemplatesDir, clusterTemplate, data)
 }
 
 type sshKeys struct {
 	authorizedHosts []byte
 	allPrivateKeys  [][]byte
 	allPublicKeys   [][]byte
+	// hostPrivateKeys and hostPublicKeys are the host keys of the members.
+	hostPrivateKeys [][]byte
+	hostPublicKeys  [][]byte
+	// trustedKeys are accepted by every member on top of the member keys.
+	trustedKeys []byte
+	// userKeys are the resolved keys of spec.Users.
+	userKeys []byte
+	// revokedKeys are left out of every authorized_keys.
+	revokedKeys []byte
 }
 
-func generateAllPods(
-	namespace string,
-	namePrefix string,
-	podNum int) []*unstructured.Unstructured {
-
-	keys := &sshKeys{
+func emptySSHKeys(podNum int) *sshKeys {
+	return &sshKeys{
 		authorizedHosts: make([]byte, 0),
-		allPrivateKeys:  make([][]byte, 0),
-		allPublicKeys:   make([][]byte, 0),
+		allPrivateKeys:  make([][]byte, podNum),
+		allPublicKeys:   make([][]byte, podNum),
+		hostPrivateKeys: make([][]byte, podNum),
+		hostPublicKeys:  make([][]byte, podNum),
 	}
-	for i := 0; i < podNum; i++ {
-		privateKey, publicKey := generateSSHKey()
-		keys.authorizedHosts = append(keys.authorizedHosts, publicKey...)
-		keys.allPrivateKeys = append(keys.allPrivateKeys, privateKey)
-		keys.allPublicKeys = append(keys.allPublicKeys, publicKey)
+}
+
+// generateSSHKeys reads the member keys that spec.Keys imports and generates
+// the others, together with a host key for every member.
+func generateSSHKeys(ctx context.Context, spec ClusterSpec, workers int) (*sshKeys, error) {
+	return completeSSHKeys(ctx, spec, emptySSHKeys(spec.PodNum), workers)
+}
+
+// completeSSHKeys fills in the member and host keys keys lacks on up to
+// workers goroutines, reading the member keys that spec.Keys imports.
+// RSA-4096 generation dominates the time of a large deploy.
+func completeSSHKeys(ctx context.Context, spec ClusterSpec, keys *sshKeys, workers int) (*sshKeys, error) {
+	podNum := spec.PodNum
+	files, err := memberKeyFiles(spec)
+	if err != nil {
+		return nil, err
 	}
+	errs := make([]error, podNum)
+	workqueue.ParallelizeUntil(ctx, workers, podNum, func(i int) {
+		if len(keys.hostPrivateKeys[i]) == 0 || len(keys.hostPublicKeys[i]) == 0 {
+			keys.hostPrivateKeys[i], keys.hostPublicKeys[i], errs[i] = generateHostKey()
+			if errs[i] != nil {
+				return
+			}
+		}
+		if len(keys.allPrivateKeys[i]) != 0 && len(keys.allPublicKeys[i]) != 0 {
+			return
+		}
+		if file, ok := files[i]; ok {
+			keys.allPrivateKeys[i], keys.allPublicKeys[i], errs[i] = readSSHKey(file)
+			return
+		}
+		keys.allPrivateKeys[i], keys.allPublicKeys[i], errs[i] = generateSSHKey()
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	keys.authorizedHosts = make([]byte, 0)
+	for i, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+		keys.authorizedHosts = append(keys.authorizedHosts, keys.allPublicKeys[i]...)
+	}
+	return keys, nil
+}
 
+// missingMembers returns the members without a key pair.
+func (k *sshKeys) missingMembers(spec ClusterSpec) []string {
+	var missing []string
+	for i, name := range memberNames(spec) {
+		if len(k.allPrivateKeys[i]) == 0 || len(k.allPublicKeys[i]) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+func renderAllPods(
+	spec ClusterSpec,
+	keys *sshKeys) ([]*unstructured.Unstructured, error) {
+	script, _, err := readTemplate(spec.TemplatesDir, bootstraptTemplate)
+	if err != nil {
+		return nil, err
+	}
 	objs := []*unstructured.Unstructured{}
-	for i := 0; i < podNum; i++ {
-		name := fmt.Sprintf("%s-%d", namePrefix, i)
-		o := generateOnePodObjs(namespace, name, keys, i)
+	for i := 0; i < spec.PodNum; i++ {
+		name := fmt.Sprintf("%s-%d", spec.NamePrefix, i)
+		o, err := generateOnePodObjs(spec, name, bootstraptConfigMapName(script), keys, i)
+		if err != nil {
+			return nil, err
+		}
 		objs = append(objs, o...)
 	}
-	return objs
+	return objs, nil
 }
 
 func generateOnePodObjs(
-	namespace string,
+	spec ClusterSpec,
 	name string,
+	bootstraptName string,
 	keys *sshKeys,
-	index int) []*unstructured.Unstructured {
-	data := TemplateData{
-		Namespace:               namespace,
-		Name:                    name,
-		BootstraptConfigMapName: bootstraptKey,
-		Image:                   image,
-		Port:                    appPort,
-		AuthorizedKeys:          base64.StdEncoding.EncodeToString(keys.authorizedHosts),
-		SSHPrivateKey:           base64.StdEncoding.EncodeToString(keys.allPrivateKeys[index]),
-		SSHPublicKey:            base64.StdEncoding.EncodeToString(keys.allPublicKeys[index]),
-	}
-	tmpl, err := template.New("tmpl").Parse(perPodTaml)
-	if err != nil {
-		glog.Fatalf("failed to parse pod template: %v", err)
-	}
-	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, data)
-	if err != nil {
-		glog.Fatalf("failed to execute pod template: %v", err)
-	}
-	objs, err := yamlDecoder.Decode(buf.String())
-	if err != nil {
-		glog.Fatalf("failed to decode the pod yaml: %v", err)
-	}
-	return objs
+	index int) ([]*unstructured.Unstructured, error) {
+	data := newTemplateData(spec)
+	data.Name = name
+	data.Index = index
+	data.BootstraptConfigMapName = bootstraptName
+	data.Labels = memberLabels(spec, name, index)
+	authorizedKeys := removeKeys(append(append([]byte{}, keys.authorizedHosts...), keys.trustedKeys...), keys.revokedKeys)
+	data.AuthorizedKeys = base64.StdEncoding.EncodeToString(authorizedKeys)
+	data.SSHPrivateKey = base64.StdEncoding.EncodeToString(keys.allPrivateKeys[index])
+	data.SSHPublicKey = base64.StdEncoding.EncodeToString(keys.allPublicKeys[index])
+	data.SSHHostKey = base64.StdEncoding.EncodeToString(keys.hostPrivateKeys[index])
+	data.SSHHostPublicKey = base64.StdEncoding.EncodeToString(keys.hostPublicKeys[index])
+	return renderTemplate(spec.TemplatesDir, podTemplate, data)
 }
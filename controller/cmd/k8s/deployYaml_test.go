@@ -0,0 +1,110 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRenderPersistentHome(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := ClusterSpec{
+		Namespace:  "ns",
+		NamePrefix: "sample",
+		PodNum:     2,
+		Probe:      DefaultProbeSpec(),
+		Persistence: PersistenceSpec{
+			Enabled:          true,
+			Size:             "5Gi",
+			StorageClassName: "standard-rwo",
+			RetentionPolicy:  RetentionPolicyKeep,
+		},
+	}
+	g.Expect(spec.Validate()).To(gomega.Succeed())
+
+	objs, err := renderAllPods(spec, emptySSHKeys(spec.PodNum))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(len(objs)).To(gomega.Equal(8))
+	g.Expect(objs[0].GetKind()).To(gomega.Equal("PersistentVolumeClaim"))
+	g.Expect(objs[0].GetName()).To(gomega.Equal("sample-0-home"))
+	class, _, _ := unstructured.NestedString(objs[0].Object, "spec", "storageClassName")
+	g.Expect(class).To(gomega.Equal("standard-rwo"))
+
+	volumes, _, _ := unstructured.NestedSlice(objs[1].Object, "spec", "template", "spec", "volumes")
+	g.Expect(volumes).To(gomega.ContainElement(map[string]interface{}{
+		"name": "home",
+		"persistentVolumeClaim": map[string]interface{}{
+			"claimName": "sample-0-home",
+		},
+	}))
+}
+
+func TestRenderEphemeralHome(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+	g.Expect(spec.Validate()).To(gomega.Succeed())
+
+	objs, err := renderAllPods(spec, emptySSHKeys(spec.PodNum))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(len(objs)).To(gomega.Equal(3))
+	g.Expect(objs[0].GetKind()).To(gomega.Equal("Deployment"))
+}
+
+func TestRenderNetworkPolicy(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := ClusterSpec{
+		Namespace:  "ns",
+		NamePrefix: "sample",
+		PodNum:     1,
+		Probe:      DefaultProbeSpec(),
+		NetworkPolicy: NetworkPolicySpec{
+			Enabled:           true,
+			AllowedCIDRs:      []string{"10.0.0.0/8"},
+			AllowedNamespaces: []string{"bastion"},
+		},
+	}
+	g.Expect(spec.Validate()).To(gomega.Succeed())
+
+	objs, err := generateClusterObjs(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(objs)).To(gomega.Equal([]string{"ConfigMap/sample-cluster", "NetworkPolicy/sample-ssh"}))
+	ingress, _, _ := unstructured.NestedSlice(objs[1].Object, "spec", "ingress")
+	g.Expect(len(ingress)).To(gomega.Equal(1))
+	from, _, _ := unstructured.NestedSlice(ingress[0].(map[string]interface{}), "from")
+	g.Expect(len(from)).To(gomega.Equal(3))
+
+	spec.NetworkPolicy.Enabled = false
+	objs, err = generateClusterObjs(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(objs)).To(gomega.Equal([]string{"ConfigMap/sample-cluster"}))
+
+	spec.NetworkPolicy.AllowedCIDRs = []string{"10.0.0.0"}
+	g.Expect(spec.Validate()).NotTo(gomega.Succeed())
+}
+
+func TestRenderProbes(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+	spec.Probe.LivenessFailureThreshold = 7
+
+	objs, err := renderAllPods(spec, emptySSHKeys(spec.PodNum))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	containers, _, _ := unstructured.NestedSlice(objs[0].Object, "spec", "template", "spec", "containers")
+	container := containers[0].(map[string]interface{})
+	for _, probe := range []string{"startupProbe", "readinessProbe", "livenessProbe"} {
+		command, _, _ := unstructured.NestedStringSlice(container, probe, "exec", "command")
+		g.Expect(command).To(gomega.HaveLen(3))
+		g.Expect(command[2]).To(gomega.ContainSubstring("/dev/tcp/127.0.0.1/22"))
+		g.Expect(command[2]).To(gomega.ContainSubstring("SSH-"))
+	}
+	threshold, _, _ := unstructured.NestedInt64(container, "livenessProbe", "failureThreshold")
+	g.Expect(threshold).To(gomega.Equal(int64(7)))
+
+	spec.Probe.PeriodSeconds = 0
+	spec.PodNum = 0
+	err = spec.Validate()
+	g.Expect(err).To(gomega.BeAssignableToTypeOf(&ValidationError{}))
+	g.Expect(err.(*ValidationError).Errors).To(gomega.HaveLen(2))
+	g.Expect(err.Error()).To(gomega.ContainSubstring("probe.periodSeconds"))
+}
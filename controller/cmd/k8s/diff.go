@@ -0,0 +1,191 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"github.com/pmezard/go-difflib/difflib"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// diffFieldManager owns the fields of the dry-run applies of Diff.
+const diffFieldManager = "kubernetes-ssh-diff"
+
+// serverFields are set by the API server and differ between the live object
+// and its dry-run apply without anyone having changed the object.
+var serverFields = [][]string{
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "uid"},
+	{"metadata", "generation"},
+	{"metadata", "creationTimestamp"},
+	{"metadata", "selfLink"},
+	{"metadata", "annotations", "deployment.kubernetes.io/revision"},
+	{"status"},
+}
+
+// ObjectDiff is the drift of one object of a cluster.
+type ObjectDiff struct {
+	Kind string
+	Name string
+	// Missing is set when the object no longer exists.
+	Missing bool
+	// Diff is a unified diff from the live object to the desired one, empty
+	// when the object has not drifted.
+	Diff string
+}
+
+// Diff compares every object of the cluster with its live counterpart. The
+// desired objects are rendered like Apply renders them, with the member
+// keys read back from their Secrets, and dry-run applied server-side so
+// defaults and fields set by others do not count as drift. Secret values
+// are compared by digest and never printed. Objects of other clusters and
+// objects the spec no longer renders are not looked at.
+func (p *Provisioner) Diff(ctx context.Context, spec ClusterSpec) ([]ObjectDiff, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	keys, err := p.liveSSHKeys(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	if keys.trustedKeys, err = readTrustedKeys(spec.Keys.TrustedKeys); err != nil {
+		return nil, err
+	}
+	if keys.userKeys, err = p.resolveUserKeys(ctx, spec); err != nil {
+		return nil, err
+	}
+	if keys.revokedKeys, err = p.revokedKeys(ctx, spec); err != nil {
+		return nil, err
+	}
+	objs, err := generateObjs(spec, keys)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		return orderOf(objs[i]) < orderOf(objs[j])
+	})
+
+	// The live objects are owned by the live anchor.
+	anchor, err := p.liveAnchor(ctx, spec)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		setOwner(spec, objs, anchor)
+	}
+
+	client := p.clients.GetControllerClient()
+	diffs := []ObjectDiff{}
+	for _, o := range objs {
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(o.GroupVersionKind())
+		key := types.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}
+		err := client.Get(ctx, key, live)
+		missing := errors.IsNotFound(err)
+		if err != nil && !missing {
+			return nil, &APIError{Verb: "get", Kind: o.GetKind(), Name: o.GetName(), Err: err}
+		}
+		desired := o.DeepCopy()
+		err = client.Patch(ctx, desired, ctrl.Apply,
+			ctrl.DryRunAll, ctrl.ForceOwnership, ctrl.FieldOwner(diffFieldManager))
+		if err != nil {
+			return nil, &APIError{Verb: "dry-run apply", Kind: o.GetKind(), Name: o.GetName(), Err: err}
+		}
+		liveText := ""
+		if !missing {
+			if liveText, err = normalizedYaml(live); err != nil {
+				return nil, err
+			}
+		}
+		desiredText, err := normalizedYaml(desired)
+		if err != nil {
+			return nil, err
+		}
+		path := fmt.Sprintf("%s/%s", o.GetKind(), o.GetName())
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(liveText),
+			B:        difflib.SplitLines(desiredText),
+			FromFile: "live/" + path,
+			ToFile:   "desired/" + path,
+			Context:  3,
+		})
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, ObjectDiff{Kind: o.GetKind(), Name: o.GetName(), Missing: missing, Diff: diff})
+	}
+	return diffs, nil
+}
+
+// liveSSHKeys reads the member keys from the Secrets like loadSSHKeys, but
+// a missing Secret leaves its member without keys rather than failing. A
+// resumed Apply generates those.
+func (p *Provisioner) liveSSHKeys(ctx context.Context, spec ClusterSpec) (*sshKeys, error) {
+	client := p.clients.GetControllerClient()
+	keys := emptySSHKeys(spec.PodNum)
+	for i, name := range memberNames(spec) {
+		secret := &coreV1.Secret{}
+		err := client.Get(ctx, types.NamespacedName{Namespace: spec.Namespace, Name: name}, secret)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, &APIError{Verb: "get", Kind: "Secret", Name: name, Err: err}
+		}
+		keys.allPrivateKeys[i], keys.allPublicKeys[i] = secret.Data["id_rsa"], secret.Data["id_rsa.pub"]
+		keys.hostPrivateKeys[i], keys.hostPublicKeys[i] = secret.Data[hostKeyKey], secret.Data[hostKeyKey+".pub"]
+		keys.authorizedHosts = append(keys.authorizedHosts, keys.allPublicKeys[i]...)
+	}
+	return keys, nil
+}
+
+// normalizedYaml renders an object without its server managed fields and
+// empty values, and with the values of a Secret replaced by their digests.
+func normalizedYaml(o *unstructured.Unstructured) (string, error) {
+	o = o.DeepCopy()
+	for _, fields := range serverFields {
+		unstructured.RemoveNestedField(o.Object, fields...)
+	}
+	pruneEmpty(o.Object)
+	if o.GetKind() == "Secret" {
+		data, _, _ := unstructured.NestedMap(o.Object, "data")
+		for k, v := range data {
+			data[k] = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(fmt.Sprint(v))))
+		}
+		if data != nil {
+			unstructured.SetNestedMap(o.Object, data, "data")
+		}
+	}
+	out, err := yaml.Marshal(o.Object)
+	return string(out), err
+}
+
+// pruneEmpty drops nulls and empty maps, such as the "resources: {}" that
+// serializing a typed object adds, and reports whether m ends up empty.
+func pruneEmpty(m map[string]interface{}) bool {
+	for k, v := range m {
+		switch v := v.(type) {
+		case nil:
+			delete(m, k)
+		case map[string]interface{}:
+			if pruneEmpty(v) {
+				delete(m, k)
+			}
+		case []interface{}:
+			for _, item := range v {
+				if item, ok := item.(map[string]interface{}); ok {
+					pruneEmpty(item)
+				}
+			}
+		}
+	}
+	return len(m) == 0
+}
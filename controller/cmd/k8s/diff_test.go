@@ -0,0 +1,60 @@
+package k8s
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/onsi/gomega"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestDiff(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 2, Probe: DefaultProbeSpec()}
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	drifted := func() []string {
+		diffs, err := provisioner.Diff(ctx, spec)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		names := []string{}
+		for _, diff := range diffs {
+			if diff.Diff != "" {
+				names = append(names, diff.Kind+"/"+diff.Name)
+			}
+		}
+		return names
+	}
+	g.Expect(drifted()).To(gomega.BeEmpty())
+
+	deploy := &appsV1.Deployment{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-0"}, deploy)).To(gomega.Succeed())
+	deploy.Spec.Template.Spec.Containers[0].Image = "attacker/sshd"
+	g.Expect(client.Update(ctx, deploy)).To(gomega.Succeed())
+	secret := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-1"}, secret)).To(gomega.Succeed())
+	g.Expect(client.Delete(ctx, secret)).To(gomega.Succeed())
+
+	// Without the key of sample-1 the authorized_keys of sample-0 differ too.
+	g.Expect(drifted()).To(gomega.Equal([]string{"Secret/sample-0", "Secret/sample-1", "Deployment/sample-0"}))
+	diffs, err := provisioner.Diff(ctx, spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	for _, diff := range diffs {
+		switch diff.Kind + "/" + diff.Name {
+		case "Deployment/sample-0":
+			g.Expect(diff.Missing).To(gomega.BeFalse())
+			g.Expect(diff.Diff).To(gomega.HavePrefix("--- live/Deployment/sample-0\n+++ desired/Deployment/sample-0\n"))
+			g.Expect(diff.Diff).To(gomega.ContainSubstring("\n-        image: attacker/sshd\n+        image: " + image + "\n"))
+			g.Expect(diff.Diff).NotTo(gomega.ContainSubstring("resourceVersion"))
+		case "Secret/sample-1":
+			g.Expect(diff.Missing).To(gomega.BeTrue())
+		case "Secret/sample-0":
+			g.Expect(diff.Diff).To(gomega.ContainSubstring("authorized_keys: sha256:"))
+			g.Expect(diff.Diff).NotTo(gomega.ContainSubstring(base64.StdEncoding.EncodeToString(secret.Data["id_rsa.pub"])))
+		}
+	}
+}
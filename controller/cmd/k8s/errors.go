@@ -0,0 +1,149 @@
+package k8s
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ErrNoMembers is returned when a command finds no member of a cluster.
+var ErrNoMembers = errors.New("no cluster members found")
+
+// ValidationError reports every problem of an invalid ClusterSpec.
+type ValidationError struct {
+	Errors field.ErrorList
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid cluster spec: %v", e.Errors.ToAggregate())
+}
+
+// TemplateError reports a template that failed to parse, execute or decode.
+type TemplateError struct {
+	Template string
+	// Path is the file the template was read from and Line the line of the
+	// error in it, when known.
+	Path string
+	Line int
+	Err  error
+}
+
+func (e *TemplateError) Error() string {
+	location := e.Template
+	if e.Path != "" {
+		location = e.Path
+	}
+	if e.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, e.Line)
+	}
+	return fmt.Sprintf("template %s: %v", location, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// KeyError reports a failure to generate or parse SSH keys.
+type KeyError struct {
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("ssh key: %v", e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// APIError reports a failed Kubernetes API call. The underlying error can be
+// inspected with the helpers of k8s.io/apimachinery/pkg/api/errors.
+type APIError struct {
+	Verb string
+	Kind string
+	Name string
+	Err  error
+}
+
+func (e *APIError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("failed to %s %s: %v", e.Verb, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("failed to %s %s %q: %v", e.Verb, e.Kind, e.Name, e.Err)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// NotReadyError reports the members that did not become ready in time and
+// why.
+type NotReadyError struct {
+	Cluster string
+	Timeout time.Duration
+	// Failed is the member that made the wait stop before the timeout,
+	// empty when it expired.
+	Failed string
+	// Diagnoses is indexed by member name.
+	Diagnoses map[string]string
+}
+
+func (e *NotReadyError) Error() string {
+	members := make([]string, 0, len(e.Diagnoses))
+	for member := range e.Diagnoses {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return memberLess(members[i], members[j]) })
+	lines := []string{fmt.Sprintf("cluster %q is not ready after %v", e.Cluster, e.Timeout)}
+	if e.Failed != "" {
+		lines[0] = fmt.Sprintf("cluster %q will not become ready, %s is failing", e.Cluster, e.Failed)
+	}
+	for _, member := range members {
+		lines = append(lines, fmt.Sprintf("%s: %s", member, e.Diagnoses[member]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PermissionError lists the permissions the current user lacks.
+type PermissionError struct {
+	Missing []Permission
+}
+
+func (e *PermissionError) Error() string {
+	lines := []string{fmt.Sprintf("missing %d permissions:", len(e.Missing))}
+	for _, permission := range e.Missing {
+		lines = append(lines, permission.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PreflightError lists every problem Preflight found.
+type PreflightError struct {
+	Problems []string
+}
+
+func (e *PreflightError) Error() string {
+	lines := []string{fmt.Sprintf("preflight found %d problems:", len(e.Problems))}
+	lines = append(lines, e.Problems...)
+	return strings.Join(lines, "\n")
+}
+
+// RotateError reports the step a key rotation stopped at. Before the old keys
+// are dropped every member still trusts them, so running the rotation again
+// is safe.
+type RotateError struct {
+	Stage RotateStage
+	Err   error
+}
+
+func (e *RotateError) Error() string {
+	return fmt.Sprintf("key rotation stopped at %s: %v", e.Stage, e.Err)
+}
+
+func (e *RotateError) Unwrap() error {
+	return e.Err
+}
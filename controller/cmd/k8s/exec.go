@@ -0,0 +1,45 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// execInPod runs a command in a container of a pod, like kubectl exec, and
+// returns what it wrote to stdout and stderr.
+func execInPod(
+	ctx context.Context,
+	clients Clients,
+	pod *coreV1.Pod,
+	container string,
+	command []string,
+	stdin io.Reader) (string, string, error) {
+	req := clients.GetClientSet().CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&coreV1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(clients.GetRestConfig(), "POST", req.URL())
+	if err != nil {
+		return "", "", err
+	}
+	var stdout, stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	return stdout.String(), stderr.String(), err
+}
@@ -0,0 +1,194 @@
+package k8s
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+// ExportFormat selects what Export produces.
+type ExportFormat string
+
+const (
+	// ExportFormatHelm is a chart whose values default to the spec.
+	ExportFormatHelm ExportFormat = "helm"
+	// ExportFormatKustomize is a base for the spec plus an overlay setting
+	// its namespace.
+	ExportFormatKustomize ExportFormat = "kustomize"
+)
+
+const (
+	exportDir           = "templates/export"
+	exportHelmDir       = exportDir + "/helm"
+	exportKustomizeDir  = exportDir + "/kustomize"
+	exportBootstraptKey = exportDir + "/bootstrapt.sh"
+)
+
+// Export renders the cluster for Helm or Kustomize and returns the files by
+// their slash separated path. No key is part of the output: the chart
+// generates missing keys at install time, the Kustomize base reads them from
+// files that its generate-keys.sh creates. Both keep all private keys in one
+// Secret that only the init containers mount, each member derives its
+// authorized_keys from it. A spec using a feature the export templates lack
+// is a *ValidationError. The exported members carry the labels status and
+// check find them by, but have no users or revoked keys ConfigMap.
+func Export(spec ClusterSpec, format ExportFormat) (map[string][]byte, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if errs := unsupportedByExport(spec); len(errs) != 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+	script, err := embeddedTemplates.ReadFile(exportBootstraptKey)
+	if err != nil {
+		return nil, err
+	}
+	data := newTemplateData(spec)
+	switch format {
+	case ExportFormatHelm:
+		return exportHelm(data, script)
+	case ExportFormatKustomize:
+		return exportKustomize(spec, data, script)
+	}
+	return nil, &ValidationError{Errors: field.ErrorList{field.NotSupported(
+		field.NewPath("format"), format,
+		[]string{string(ExportFormatHelm), string(ExportFormatKustomize)})}}
+}
+
+// unsupportedByExport lists the features of spec the export templates lack,
+// which would otherwise be dropped without notice.
+func unsupportedByExport(spec ClusterSpec) field.ErrorList {
+	errs := field.ErrorList{}
+	forbid := func(set bool, path *field.Path, detail string) {
+		if set {
+			errs = append(errs, field.Forbidden(path, detail))
+		}
+	}
+	keysPath := field.NewPath("keys")
+	forbid(spec.Keys.MemberKeysDir != "", keysPath.Child("memberKeysDir"), "no key is exported")
+	forbid(len(spec.Keys.MemberKeys) != 0, keysPath.Child("memberKeys"), "no key is exported")
+	forbid(len(spec.Keys.TrustedKeys) != 0, keysPath.Child("trustedKeys"), "exported members only trust each other")
+	forbid(spec.Keys.RotationInterval != nil, keysPath.Child("rotationInterval"), "exported clusters have no controller")
+	forbid(len(spec.Users) != 0, field.NewPath("users"), "exported members only trust each other")
+	forbid(len(spec.LoginUsers) != 0, field.NewPath("loginUsers"), "exported members only log in as root")
+	forbid(spec.PodSecurity.Restricted, field.NewPath("podSecurity", "restricted"), "exported members run as root")
+	forbid(spec.TemplatesDir != "", field.NewPath("templatesDir"), "export only uses its embedded templates")
+	return errs
+}
+
+// exportHelm copies the chart templates as they are, they are Helm's to
+// execute, and renders Chart.yaml and values.yaml from the spec.
+func exportHelm(data TemplateData, script []byte) (map[string][]byte, error) {
+	files := map[string][]byte{"files/bootstrapt.sh": script}
+	err := fs.WalkDir(embeddedTemplates, exportHelmDir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel := strings.TrimPrefix(name, exportHelmDir+"/")
+		if strings.HasPrefix(rel, "templates/") {
+			files[rel], err = embeddedTemplates.ReadFile(name)
+			return err
+		}
+		files[rel], err = renderExportFile(name, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func exportKustomize(
+	spec ClusterSpec,
+	data TemplateData,
+	script []byte) (map[string][]byte, error) {
+	files := map[string][]byte{"base/bootstrapt.sh": script}
+	for name, source := range map[string]string{
+		"base/kustomization.yaml":                            "base/kustomization.yaml",
+		"base/members.yaml":                                  "base/members.yaml",
+		"base/generate-keys.sh":                              "base/generate-keys.sh",
+		"base/.gitignore":                                    "base/gitignore",
+		"overlays/" + spec.Namespace + "/kustomization.yaml": "overlay/kustomization.yaml",
+	} {
+		content, err := renderExportFile(exportKustomizeDir+"/"+source, data)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+	if spec.NetworkPolicy.Enabled {
+		objs, err := generateClusterObjs(spec)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		for _, o := range objs {
+			// The anchor ConfigMap only matters to Apply, which makes it
+			// own the cluster.
+			if o.GetKind() != "NetworkPolicy" {
+				continue
+			}
+			// The overlay decides the namespace.
+			o.SetNamespace("")
+			content, err := yaml.Marshal(o.Object)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buf, "---\n%s", content)
+		}
+		files["base/networkpolicy.yaml"] = buf.Bytes()
+	}
+	return files, nil
+}
+
+// renderExportFile executes one of the embedded export templates.
+func renderExportFile(name string, data TemplateData) ([]byte, error) {
+	text, err := embeddedTemplates.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	base := path.Base(name)
+	tmpl, err := template.New(base).Funcs(templateFuncs).Parse(string(text))
+	if err != nil {
+		return nil, newTemplateError(base, "embedded "+name, "failed to parse", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, newTemplateError(base, "embedded "+name, "failed to execute", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteExport writes the files of Export below dir. Scripts are made
+// executable, existing files are overwritten and nothing else is touched, so
+// the keys of a Kustomize base survive a new export.
+func WriteExport(dir string, files map[string][]byte) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, ".sh") {
+			mode = 0755
+		}
+		if err := os.WriteFile(target, files[name], mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
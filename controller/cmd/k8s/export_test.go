@@ -0,0 +1,99 @@
+package k8s
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/zicongmei/kubernetes-ssh/controller/cmd/k8s/yamlDecoder"
+	"sigs.k8s.io/yaml"
+)
+
+func TestExportHelm(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := DefaultClusterSpec()
+	spec.PodNum = 3
+	spec.NetworkPolicy.AllowedCIDRs = []string{"10.0.0.0/8", "192.168.0.0/16"}
+
+	files, err := Export(spec, ExportFormatHelm)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(files).To(gomega.HaveKey("Chart.yaml"))
+	g.Expect(files).To(gomega.HaveKey("files/bootstrapt.sh"))
+	g.Expect(files).To(gomega.HaveKey("templates/_helpers.tpl"))
+	g.Expect(files).To(gomega.HaveKey("templates/members.yaml"))
+	for name, content := range files {
+		g.Expect(string(content)).NotTo(gomega.ContainSubstring("PRIVATE KEY"), name)
+	}
+
+	values := map[string]interface{}{}
+	g.Expect(yaml.UnmarshalStrict(files["values.yaml"], &values)).To(gomega.Succeed())
+	g.Expect(values["namePrefix"]).To(gomega.Equal("sample"))
+	g.Expect(values["replicas"]).To(gomega.BeNumerically("==", 3))
+	g.Expect(values["image"]).To(gomega.Equal(image))
+	g.Expect(values["port"]).To(gomega.BeNumerically("==", appPort))
+	g.Expect(values["networkPolicy"]).To(gomega.HaveKeyWithValue("allowedCIDRs",
+		[]interface{}{"10.0.0.0/8", "192.168.0.0/16"}))
+	chart := map[string]interface{}{}
+	g.Expect(yaml.UnmarshalStrict(files["Chart.yaml"], &chart)).To(gomega.Succeed())
+	g.Expect(chart["name"]).To(gomega.Equal("sample"))
+}
+
+func TestExportKustomize(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := DefaultClusterSpec()
+	spec.Persistence.Enabled = true
+
+	files, err := Export(spec, ExportFormatKustomize)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(string(files["base/kustomization.yaml"])).To(gomega.ContainSubstring("- keys/sample-1\n"))
+	g.Expect(string(files["base/generate-keys.sh"])).To(gomega.ContainSubstring("for member in sample-0 sample-1;"))
+	g.Expect(string(files["overlays/default/kustomization.yaml"])).To(gomega.ContainSubstring("namespace: default\n"))
+
+	objs, err := yamlDecoder.Decode(string(files["base/members.yaml"]))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(objs)).To(gomega.Equal([]string{
+		"PersistentVolumeClaim/sample-0-home", "Service/sample-0", "Deployment/sample-0",
+		"PersistentVolumeClaim/sample-1-home", "Service/sample-1", "Deployment/sample-1",
+	}))
+	objs, err = yamlDecoder.Decode(string(files["base/networkpolicy.yaml"]))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(objs)).To(gomega.Equal([]string{"NetworkPolicy/sample-ssh"}))
+	g.Expect(objs[0].GetNamespace()).To(gomega.BeEmpty())
+
+	// A new export leaves the generated keys alone.
+	dir := t.TempDir()
+	g.Expect(os.MkdirAll(filepath.Join(dir, "base", "keys"), 0700)).To(gomega.Succeed())
+	key := filepath.Join(dir, "base", "keys", "sample-0")
+	g.Expect(os.WriteFile(key, []byte("key"), 0600)).To(gomega.Succeed())
+	g.Expect(WriteExport(dir, files)).To(gomega.Succeed())
+	g.Expect(os.ReadFile(key)).To(gomega.Equal([]byte("key")))
+	info, err := os.Stat(filepath.Join(dir, "base", "generate-keys.sh"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(info.Mode().Perm() & 0100).NotTo(gomega.BeZero())
+
+	_, err = Export(spec, ExportFormat("jsonnet"))
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(strings.Contains(err.Error(), "format")).To(gomega.BeTrue())
+}
+
+func TestExportUnsupported(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	_, publicKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	spec := DefaultClusterSpec()
+	spec.Keys.TrustedKeys = []string{"bastion.pub"}
+	spec.Users = []UserKeySpec{{Name: "alice", Key: strings.TrimSpace(string(publicKey))}}
+	spec.LoginUsers = []LoginUserSpec{{Name: "bob"}}
+
+	_, err = Export(spec, ExportFormatHelm)
+	var validationErr *ValidationError
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+	var fields []string
+	for _, e := range validationErr.Errors {
+		fields = append(fields, e.Field)
+	}
+	g.Expect(fields).To(gomega.Equal([]string{"keys.trustedKeys", "users", "loginUsers"}))
+}
@@ -0,0 +1,287 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/glog"
+	authorizationV1 "k8s.io/api/authorization/v1"
+	rbacV1 "k8s.io/api/rbac/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+// InstallScope decides where the controller may manage clusters.
+type InstallScope string
+
+const (
+	// InstallScopeNamespace grants a Role in the namespace of the spec,
+	// which must exist before the controller starts.
+	InstallScopeNamespace InstallScope = "namespace"
+	// InstallScopeCluster grants the same permissions in every namespace
+	// through a ClusterRole, which may also create the namespace.
+	InstallScopeCluster InstallScope = "cluster"
+)
+
+const (
+	controllerImage = "sheixinsheisb/kssh-controller"
+	// controllerSpecDir is where the controller mounts its spec file.
+	controllerSpecDir = "/etc/kssh-controller"
+)
+
+// InstallOptions tunes what Install sets up.
+type InstallOptions struct {
+	Scope InstallScope
+	// Image runs the controller. Empty means the default image.
+	Image string
+}
+
+func (o InstallOptions) image() string {
+	if o.Image == "" {
+		return controllerImage
+	}
+	return o.Image
+}
+
+// controllerRules are the permissions an installed controller uses in its
+// namespace: it deploys with FailurePolicyKeep, so it never deletes, rotates
+// the keys on schedule and watches the status. Diagnoses of a failed
+// rotation go without the pod logs and events.
+var controllerRules = []rbacV1.PolicyRule{
+	{APIGroups: []string{""}, Resources: []string{"configmaps", "secrets"}, Verbs: []string{"get", "list", "watch", "create", "update"}},
+	{APIGroups: []string{""}, Resources: []string{"services", "persistentvolumeclaims"}, Verbs: []string{"get", "create"}},
+	{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list", "watch"}},
+	{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}},
+	{APIGroups: []string{""}, Resources: []string{"endpoints"}, Verbs: []string{"list", "watch"}},
+	{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"get", "list", "watch", "create", "patch"}},
+	{APIGroups: []string{"networking.k8s.io"}, Resources: []string{"networkpolicies"}, Verbs: []string{"get", "create"}},
+}
+
+// commandRules are the permissions of every command, limited to the verbs
+// they use. They are what CheckCommandPermissions asks about.
+var commandRules = []rbacV1.PolicyRule{
+	{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "list", "watch", "create", "update", "delete"}},
+	{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get", "list", "watch", "create", "update", "delete"}},
+	{APIGroups: []string{""}, Resources: []string{"services", "persistentvolumeclaims"}, Verbs: []string{"get", "create", "delete"}},
+	{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list", "watch"}},
+	{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}},
+	{APIGroups: []string{""}, Resources: []string{"pods/log"}, Verbs: []string{"get"}},
+	{APIGroups: []string{""}, Resources: []string{"endpoints"}, Verbs: []string{"list", "watch"}},
+	{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"list"}},
+	{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"get", "list", "watch", "create", "patch", "delete"}},
+	{APIGroups: []string{"networking.k8s.io"}, Resources: []string{"networkpolicies"}, Verbs: []string{"get", "create", "delete"}},
+}
+
+// namespaceRule covers the namespace itself. Namespaces are cluster scoped,
+// so only a ClusterRole can grant it.
+var namespaceRule = rbacV1.PolicyRule{
+	APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"get", "create"},
+}
+
+// clusterRules are what the ClusterRole of InstallScopeCluster grants: the
+// controllerRules in every namespace and the namespaces themselves.
+func (o InstallOptions) clusterRules() []rbacV1.PolicyRule {
+	if o.Scope == InstallScopeCluster {
+		return append([]rbacV1.PolicyRule{namespaceRule}, controllerRules...)
+	}
+	return nil
+}
+
+// validate checks the options and that spec can be read in the cluster:
+// local files are not there.
+func (o InstallOptions) validate(spec ClusterSpec) error {
+	errs := field.ErrorList{}
+	switch o.Scope {
+	case InstallScopeNamespace, InstallScopeCluster:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("scope"), o.Scope,
+			[]string{string(InstallScopeNamespace), string(InstallScopeCluster)}))
+	}
+	const local = "is a local file the controller cannot read"
+	if spec.TemplatesDir != "" {
+		errs = append(errs, field.Forbidden(field.NewPath("templatesDir"), local))
+	}
+	keysPath := field.NewPath("keys")
+	if spec.Keys.MemberKeysDir != "" {
+		errs = append(errs, field.Forbidden(keysPath.Child("memberKeysDir"), local))
+	}
+	if len(spec.Keys.MemberKeys) != 0 {
+		errs = append(errs, field.Forbidden(keysPath.Child("memberKeys"), local))
+	}
+	if len(spec.Keys.TrustedKeys) != 0 {
+		errs = append(errs, field.Forbidden(keysPath.Child("trustedKeys"), local))
+	}
+	for i, user := range spec.Users {
+		if user.File != "" {
+			errs = append(errs, field.Forbidden(field.NewPath("users").Index(i).Child("file"), local))
+		}
+	}
+	if len(errs) != 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// GenerateInstallObjs renders the objects that run the controller of spec:
+// its ServiceAccount, role and binding, the spec file and the Deployment.
+func GenerateInstallObjs(spec ClusterSpec, options InstallOptions) ([]*unstructured.Unstructured, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if err := options.validate(spec); err != nil {
+		return nil, err
+	}
+	specFile, err := MarshalClusterSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	data := newTemplateData(spec)
+	data.ControllerName = spec.NamePrefix + "-controller"
+	data.ControllerImage = options.image()
+	data.ControllerSpec = string(specFile)
+	data.ControllerSpecDir = controllerSpecDir
+	data.ControllerRules = controllerRules
+	data.ControllerClusterRules = options.clusterRules()
+	return renderTemplate("", installTemplate, data)
+}
+
+// Install applies the objects of GenerateInstallObjs. RBAC does not let
+// anyone grant permissions they do not hold, so the missing ones are
+// reported as a *PermissionError before anything is written.
+func (p *Provisioner) Install(
+	ctx context.Context,
+	spec ClusterSpec,
+	options InstallOptions) ([]*unstructured.Unstructured, error) {
+	objs, err := GenerateInstallObjs(spec, options)
+	if err != nil {
+		return nil, err
+	}
+	missing, err := p.CheckPermissions(ctx, spec.Namespace, options.Scope)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) != 0 {
+		return nil, &PermissionError{Missing: missing}
+	}
+	for _, o := range objs {
+		if err := p.createOrUpdate(ctx, o); err != nil {
+			return nil, err
+		}
+		glog.Infof("installed %q object %q", o.GetKind(), o.GetName())
+	}
+	return objs, nil
+}
+
+// Permission is one verb on a resource, in Namespace or, when it is empty,
+// in every namespace.
+type Permission struct {
+	Verb        string `json:"verb"`
+	Group       string `json:"group,omitempty"`
+	Resource    string `json:"resource"`
+	Subresource string `json:"subresource,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+}
+
+func (p Permission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	if p.Subresource != "" {
+		resource += "/" + p.Subresource
+	}
+	if p.Namespace == "" || p.Resource == "namespaces" {
+		return fmt.Sprintf("%s %s", p.Verb, resource)
+	}
+	return fmt.Sprintf("%s %s in namespace %s", p.Verb, resource, p.Namespace)
+}
+
+// CheckPermissions returns the permissions of the controller with the given
+// scope that the current user lacks. They are checked in namespace, with
+// InstallScopeCluster in every namespace.
+func (p *Provisioner) CheckPermissions(
+	ctx context.Context,
+	namespace string,
+	scope InstallScope) ([]Permission, error) {
+	if rules := (InstallOptions{Scope: scope}).clusterRules(); rules != nil {
+		return p.missingPermissions(ctx, rulePermissions(rules, ""))
+	}
+	return p.missingPermissions(ctx, rulePermissions(controllerRules, namespace))
+}
+
+// CheckCommandPermissions returns the permissions the commands use in
+// namespace that the current user lacks, including creating the namespace.
+func (p *Provisioner) CheckCommandPermissions(ctx context.Context, namespace string) ([]Permission, error) {
+	rules := append([]rbacV1.PolicyRule{namespaceRule}, commandRules...)
+	return p.missingPermissions(ctx, rulePermissions(rules, namespace))
+}
+
+// rulePermissions splits rules into single permissions in namespace, in
+// every namespace when it is empty.
+func rulePermissions(rules []rbacV1.PolicyRule, namespace string) []Permission {
+	var permissions []Permission
+	for _, rule := range rules {
+		for _, resource := range rule.Resources {
+			resource, subresource, _ := strings.Cut(resource, "/")
+			for _, verb := range rule.Verbs {
+				permissions = append(permissions, Permission{
+					Verb:        verb,
+					Group:       rule.APIGroups[0],
+					Resource:    resource,
+					Subresource: subresource,
+					Namespace:   namespace,
+				})
+			}
+		}
+	}
+	return permissions
+}
+
+// missingPermissions asks the API server about each permission with a
+// SelfSubjectAccessReview and returns the denied ones.
+func (p *Provisioner) missingPermissions(ctx context.Context, permissions []Permission) ([]Permission, error) {
+	reviews := p.clients.GetClientSet().AuthorizationV1().SelfSubjectAccessReviews()
+	missing := []Permission{}
+	for _, permission := range permissions {
+		// Namespaces are cluster scoped.
+		if permission.Resource == "namespaces" {
+			permission.Namespace = ""
+		}
+		review, err := reviews.Create(ctx, &authorizationV1.SelfSubjectAccessReview{
+			Spec: authorizationV1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationV1.ResourceAttributes{
+					Namespace:   permission.Namespace,
+					Verb:        permission.Verb,
+					Group:       permission.Group,
+					Resource:    permission.Resource,
+					Subresource: permission.Subresource,
+				},
+			},
+		}, metaV1.CreateOptions{})
+		if err != nil {
+			return nil, &APIError{Verb: "create", Kind: "SelfSubjectAccessReview", Err: err}
+		}
+		if !review.Status.Allowed {
+			missing = append(missing, permission)
+		}
+	}
+	return missing, nil
+}
+
+// PrintObjects writes objs as a multi-document YAML stream.
+func PrintObjects(w io.Writer, objs []*unstructured.Unstructured) error {
+	for _, o := range objs {
+		out, err := yaml.Marshal(o.Object)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "---\n%s", out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/onsi/gomega"
+	authorizationV1 "k8s.io/api/authorization/v1"
+	rbacV1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+	ctrlFake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGenerateInstallObjs(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := DefaultClusterSpec()
+	spec.Namespace = "ns"
+	spec.PodNum = 3
+
+	objs, err := GenerateInstallObjs(spec, InstallOptions{Scope: InstallScopeNamespace})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(objs)).To(gomega.Equal([]string{
+		"Namespace/ns", "ServiceAccount/sample-controller", "Role/sample-controller",
+		"RoleBinding/sample-controller", "ConfigMap/sample-controller", "Deployment/sample-controller",
+	}))
+	// The controller reads back the spec it was installed with.
+	content := objs[4].Object["data"].(map[string]interface{})["spec.yaml"].(string)
+	g.Expect(ParseClusterSpec(content)).To(gomega.Equal(spec))
+	role := &rbacV1.Role{}
+	g.Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(objs[2].Object, role)).To(gomega.Succeed())
+	g.Expect(role.Rules).To(gomega.Equal(controllerRules))
+
+	// A cluster wide install grants the same in every namespace, and the
+	// namespaces themselves.
+	objs, err = GenerateInstallObjs(spec, InstallOptions{Scope: InstallScopeCluster, Image: "registry.local/kssh"})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(objs)).To(gomega.Equal([]string{
+		"Namespace/ns", "ServiceAccount/sample-controller", "ClusterRole/ns-sample-controller",
+		"ClusterRoleBinding/ns-sample-controller", "ConfigMap/sample-controller", "Deployment/sample-controller",
+	}))
+	clusterRole := &rbacV1.ClusterRole{}
+	g.Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(objs[2].Object, clusterRole)).To(gomega.Succeed())
+	g.Expect(clusterRole.Rules).To(gomega.Equal(append([]rbacV1.PolicyRule{namespaceRule}, controllerRules...)))
+	for _, rule := range controllerRules {
+		g.Expect(rule.Resources).NotTo(gomega.ContainElement("pods/log"))
+		g.Expect(rule.Verbs).NotTo(gomega.ContainElement("delete"))
+	}
+
+	spec.Keys.TrustedKeys = []string{"/home/me/.ssh/id_rsa.pub"}
+	_, err = GenerateInstallObjs(spec, InstallOptions{Scope: "everywhere"})
+	var validationErr *ValidationError
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Errors).To(gomega.HaveLen(2))
+}
+
+func TestInstall(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	var checked []authorizationV1.ResourceAttributes
+	clientSet := fake.NewSimpleClientset()
+	clientSet.PrependReactor("create", "selfsubjectaccessreviews",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8sTesting.CreateAction).GetObject().(*authorizationV1.SelfSubjectAccessReview)
+			attributes := *review.Spec.ResourceAttributes
+			checked = append(checked, attributes)
+			review.Status.Allowed = attributes.Subresource != "exec"
+			return true, review, nil
+		})
+	client := ctrlFake.NewClientBuilder().Build()
+	provisioner := NewProvisioner(NewClients(nil, clientSet, client))
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+
+	_, err := provisioner.Install(ctx, spec, InstallOptions{Scope: InstallScopeCluster})
+	var permissionErr *PermissionError
+	g.Expect(errors.As(err, &permissionErr)).To(gomega.BeTrue())
+	g.Expect(permissionErr.Missing).To(gomega.Equal([]Permission{
+		{Verb: "create", Resource: "pods", Subresource: "exec"},
+	}))
+	g.Expect(err.Error()).To(gomega.HaveSuffix("\ncreate pods/exec"))
+	g.Expect(checked[0]).To(gomega.Equal(authorizationV1.ResourceAttributes{
+		Verb: "get", Resource: "namespaces",
+	}))
+	g.Expect(checked).To(gomega.HaveEach(gomega.HaveField("Namespace", "")))
+
+	// A namespaced install checks in its namespace and writes nothing
+	// without the permissions either.
+	checked = nil
+	missing, err := provisioner.CheckPermissions(ctx, "ns", InstallScopeNamespace)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(missing[0].String()).To(gomega.Equal("create pods/exec in namespace ns"))
+	g.Expect(checked).To(gomega.HaveEach(gomega.HaveField("Namespace", "ns")))
+
+	// The commands need more than the controller.
+	checked = nil
+	missing, err = provisioner.CheckCommandPermissions(ctx, "ns")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(missing).To(gomega.HaveLen(1))
+	g.Expect(checked).To(gomega.ContainElement(authorizationV1.ResourceAttributes{
+		Namespace: "ns", Verb: "get", Resource: "pods", Subresource: "log",
+	}))
+
+	clientSet.PrependReactor("create", "selfsubjectaccessreviews",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8sTesting.CreateAction).GetObject().(*authorizationV1.SelfSubjectAccessReview)
+			review.Status.Allowed = true
+			return true, review, nil
+		})
+	objs, err := provisioner.Install(ctx, spec, InstallOptions{Scope: InstallScopeNamespace})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(objs).To(gomega.HaveLen(6))
+	// Installing again updates the objects in place.
+	spec.PodNum = 2
+	_, err = provisioner.Install(ctx, spec, InstallOptions{Scope: InstallScopeNamespace})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	role := &rbacV1.Role{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-controller"}, role)).To(gomega.Succeed())
+	g.Expect(role.Rules).To(gomega.Equal(controllerRules))
+}
@@ -0,0 +1,57 @@
+package k8s
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// podSecurityModes are the labels Pod Security admission reads the level of
+// a namespace from. Only enforce rejects pods, warn and audit let them in.
+var podSecurityModes = []string{"enforce", "warn", "audit"}
+
+const (
+	podSecurityLabelPrefix = "pod-security.kubernetes.io/"
+	podSecurityRestricted  = "restricted"
+)
+
+// checkPodSecurity compares the Pod Security Standard levels of the namespace
+// with the members of spec. Members that are not restricted are rejected
+// where the namespace enforces the restricted level, so that is an error
+// rather than a Deployment that never gets a pod. A missing namespace is
+// created by Apply without labels and passes.
+func (p *Provisioner) checkPodSecurity(ctx context.Context, spec ClusterSpec) error {
+	if spec.PodSecurity.Restricted {
+		return nil
+	}
+	client := p.clients.GetControllerClient()
+	namespace := &coreV1.Namespace{}
+	err := client.Get(ctx, types.NamespacedName{Name: spec.Namespace}, namespace)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if errors.IsForbidden(err) {
+		glog.Warningf("may not read namespace %q, its Pod Security Standard is not checked", spec.Namespace)
+		return nil
+	}
+	if err != nil {
+		return &APIError{Verb: "get", Kind: "Namespace", Name: spec.Namespace, Err: err}
+	}
+	for _, mode := range podSecurityModes {
+		if namespace.Labels[podSecurityLabelPrefix+mode] != podSecurityRestricted {
+			continue
+		}
+		if mode == "enforce" {
+			return &ValidationError{Errors: field.ErrorList{field.Required(
+				field.NewPath("podSecurity", "restricted"),
+				"namespace "+spec.Namespace+" enforces the restricted Pod Security Standard")}}
+		}
+		glog.Warningf("namespace %q %ss the restricted Pod Security Standard, members will be reported",
+			spec.Namespace, mode)
+	}
+	return nil
+}
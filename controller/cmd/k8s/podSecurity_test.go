@@ -0,0 +1,76 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/onsi/gomega"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRestricted(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := DefaultClusterSpec()
+	spec.PodSecurity.Restricted = true
+	g.Expect(spec.Validate()).To(gomega.Succeed())
+
+	objs, err := renderAllPods(spec, emptySSHKeys(spec.PodNum))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	deploy := &appsV1.Deployment{}
+	g.Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(objs[0].Object, deploy)).To(gomega.Succeed())
+	pod := deploy.Spec.Template.Spec
+	g.Expect(pod.SecurityContext.RunAsNonRoot).To(gomega.HaveValue(gomega.BeTrue()))
+	g.Expect(pod.SecurityContext.RunAsUser).To(gomega.HaveValue(gomega.BeNumerically("==", restrictedUser)))
+	g.Expect(pod.SecurityContext.SeccompProfile.Type).To(gomega.Equal(coreV1.SeccompProfileTypeRuntimeDefault))
+	for _, container := range append(pod.InitContainers, pod.Containers...) {
+		g.Expect(container.SecurityContext.AllowPrivilegeEscalation).To(gomega.HaveValue(gomega.BeFalse()))
+		g.Expect(container.SecurityContext.Capabilities.Drop).To(gomega.Equal([]coreV1.Capability{"ALL"}))
+		g.Expect(container.Env).To(gomega.ContainElement(coreV1.EnvVar{Name: "HOME", Value: restrictedHome}))
+		g.Expect(container.VolumeMounts).To(gomega.ContainElement(
+			gomega.HaveField("MountPath", restrictedHome+"/.ssh")))
+	}
+	container := pod.Containers[0]
+	g.Expect(container.Command).To(gomega.ContainElements("/etc/kssh/host/ssh_host_key", "2222", "UsePAM=no"))
+	g.Expect(container.Ports[0].ContainerPort).To(gomega.BeNumerically("==", restrictedPort))
+	g.Expect(memberPort(&coreV1.Pod{Spec: pod})).To(gomega.Equal(restrictedPort))
+
+	// Export keeps the members root.
+	var validationErr *ValidationError
+	_, err = Export(spec, ExportFormatHelm)
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+
+	spec.PodSecurity.Port = 22
+	spec.LoginUsers = []LoginUserSpec{{Name: "alice"}}
+	g.Expect(errors.As(spec.Validate(), &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Errors).To(gomega.HaveLen(2))
+}
+
+func TestCheckPodSecurity(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	namespace := &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{
+		Name:   "ns",
+		Labels: map[string]string{"pod-security.kubernetes.io/warn": "restricted"},
+	}}
+	provisioner, client := newFakeProvisioner(namespace)
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+
+	// Only enforce rejects pods.
+	g.Expect(provisioner.checkPodSecurity(ctx, spec)).To(gomega.Succeed())
+	namespace.Labels["pod-security.kubernetes.io/enforce"] = "restricted"
+	g.Expect(client.Update(ctx, namespace)).To(gomega.Succeed())
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{})
+	var validationErr *ValidationError
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Errors[0].Field).To(gomega.Equal("podSecurity.restricted"))
+
+	spec.PodSecurity.Restricted = true
+	g.Expect(provisioner.checkPodSecurity(ctx, spec)).To(gomega.Succeed())
+	spec.Namespace = "missing"
+	spec.PodSecurity.Restricted = false
+	g.Expect(provisioner.checkPodSecurity(ctx, spec)).To(gomega.Succeed())
+}
@@ -0,0 +1,296 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// kindResources are the API resources of the kinds Apply creates.
+var kindResources = map[string]schema.GroupResource{
+	"Namespace":             {Resource: "namespaces"},
+	"ConfigMap":             {Resource: "configmaps"},
+	"NetworkPolicy":         {Group: "networking.k8s.io", Resource: "networkpolicies"},
+	"Secret":                {Resource: "secrets"},
+	"PersistentVolumeClaim": {Resource: "persistentvolumeclaims"},
+	"Service":               {Resource: "services"},
+	"Deployment":            {Group: "apps", Resource: "deployments"},
+}
+
+// computeResources are quota resources every pod must declare once a quota
+// limits them. Members declare none, so only LimitRange defaults can help.
+var computeResources = map[coreV1.ResourceName]bool{
+	coreV1.ResourceCPU:                      true,
+	coreV1.ResourceMemory:                   true,
+	coreV1.ResourceRequestsCPU:              true,
+	coreV1.ResourceRequestsMemory:           true,
+	coreV1.ResourceLimitsCPU:                true,
+	coreV1.ResourceLimitsMemory:             true,
+	coreV1.ResourceEphemeralStorage:         true,
+	coreV1.ResourceRequestsEphemeralStorage: true,
+	coreV1.ResourceLimitsEphemeralStorage:   true,
+}
+
+// Preflight checks what would make Apply fail before anything is created:
+// the spec and the names derived from it, the namespace and its Pod Security
+// Standard, the permissions of the current user, the headroom of the
+// ResourceQuotas and objects that already exist. Every problem is returned
+// at once as a *PreflightError.
+func (p *Provisioner) Preflight(ctx context.Context, spec ClusterSpec, options ApplyOptions) error {
+	// Nothing else can be checked for an invalid spec.
+	if err := spec.Validate(); err != nil {
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			return err
+		}
+		problems := []string{}
+		for _, e := range validationErr.Errors {
+			problems = append(problems, e.Error())
+		}
+		return &PreflightError{Problems: problems}
+	}
+	objs, err := generateObjs(spec, emptySSHKeys(spec.PodNum))
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		return orderOf(objs[i]) < orderOf(objs[j])
+	})
+	problems := []string{}
+	client := p.clients.GetControllerClient()
+
+	// Like Apply, a namespace that may not be read is assumed to exist.
+	exists := true
+	err = client.Get(ctx, types.NamespacedName{Name: spec.Namespace}, &coreV1.Namespace{})
+	switch {
+	case apiErrors.IsNotFound(err):
+		exists = false
+		glog.Infof("namespace %q does not exist yet and will be created", spec.Namespace)
+	case err != nil && !apiErrors.IsForbidden(err):
+		return &APIError{Verb: "get", Kind: "Namespace", Name: spec.Namespace, Err: err}
+	}
+	if err := p.checkPodSecurity(ctx, spec); err != nil {
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			return err
+		}
+		for _, e := range validationErr.Errors {
+			problems = append(problems, e.Error())
+		}
+	}
+
+	missing, err := p.missingPermissions(ctx, deployPermissions(spec.Namespace, objs, exists, options))
+	if err != nil {
+		return err
+	}
+	for _, permission := range missing {
+		problems = append(problems, "missing permission: "+permission.String())
+	}
+	if !exists {
+		if len(problems) != 0 {
+			return &PreflightError{Problems: problems}
+		}
+		return nil
+	}
+
+	quotaProblems, err := p.quotaProblems(ctx, spec.Namespace, objs)
+	if err != nil {
+		return err
+	}
+	problems = append(problems, quotaProblems...)
+	if !options.Resume {
+		for _, o := range objs {
+			if isShared(o) {
+				continue
+			}
+			live := &unstructured.Unstructured{}
+			live.SetGroupVersionKind(o.GroupVersionKind())
+			err := client.Get(ctx, types.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}, live)
+			switch {
+			case err == nil:
+				problems = append(problems, fmt.Sprintf("%s %q already exists", o.GetKind(), o.GetName()))
+			case !apiErrors.IsNotFound(err):
+				problems = append(problems, fmt.Sprintf("cannot tell whether %s %q exists: %v", o.GetKind(), o.GetName(), err))
+			}
+		}
+	}
+	if len(problems) != 0 {
+		return &PreflightError{Problems: problems}
+	}
+	return nil
+}
+
+// deployPermissions are the permissions Apply needs to write objs, derived
+// from the calls it makes: it reads the namespace for its Pod Security
+// Standard and the ConfigMaps of the revoked keys, the users and the anchor,
+// creates every object and rolls back what it created. A resumed run also
+// reads back and updates the Secrets and ConfigMaps that exist.
+func deployPermissions(
+	namespace string,
+	objs []*unstructured.Unstructured,
+	namespaceExists bool,
+	options ApplyOptions) []Permission {
+	var permissions []Permission
+	seen := map[Permission]bool{}
+	add := func(verb string, kind string) {
+		resource := kindResources[kind]
+		permission := Permission{Verb: verb, Group: resource.Group, Resource: resource.Resource, Namespace: namespace}
+		if !seen[permission] {
+			seen[permission] = true
+			permissions = append(permissions, permission)
+		}
+	}
+	add("get", "Namespace")
+	add("get", "ConfigMap")
+	for _, o := range objs {
+		kind := o.GetKind()
+		if kind == "Namespace" && namespaceExists {
+			continue
+		}
+		add("create", kind)
+		if options.OnFailure != FailurePolicyKeep && !isShared(o) {
+			add("delete", kind)
+		}
+		if options.Resume && (kind == "Secret" || kind == "ConfigMap") {
+			add("get", kind)
+			add("update", kind)
+		}
+	}
+	return permissions
+}
+
+// quotaProblems compares the ResourceQuotas of the namespace with what objs
+// add to them. Every object is counted, though a resumed run may already
+// have created some. Scoped quotas are left to the API server.
+func (p *Provisioner) quotaProblems(
+	ctx context.Context,
+	namespace string,
+	objs []*unstructured.Unstructured) ([]string, error) {
+	client := p.clients.GetControllerClient()
+	quotas := &coreV1.ResourceQuotaList{}
+	err := client.List(ctx, quotas, ctrl.InNamespace(namespace))
+	if apiErrors.IsForbidden(err) {
+		glog.Warningf("may not list ResourceQuotas in %q, their headroom is not checked", namespace)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &APIError{Verb: "list", Kind: "ResourceQuota", Err: err}
+	}
+	if len(quotas.Items) == 0 {
+		return nil, nil
+	}
+	limitRanges := &coreV1.LimitRangeList{}
+	if err := client.List(ctx, limitRanges, ctrl.InNamespace(namespace)); err != nil && !apiErrors.IsForbidden(err) {
+		return nil, &APIError{Verb: "list", Kind: "LimitRange", Err: err}
+	}
+
+	usage := quotaUsage(objs)
+	var problems []string
+	for _, quota := range quotas.Items {
+		if len(quota.Spec.Scopes) != 0 || quota.Spec.ScopeSelector != nil {
+			continue
+		}
+		names := make([]string, 0, len(quota.Spec.Hard))
+		for name := range quota.Spec.Hard {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			name := coreV1.ResourceName(name)
+			if computeResources[name] {
+				if !isDefaulted(limitRanges.Items, name) {
+					problems = append(problems, fmt.Sprintf(
+						"ResourceQuota %q limits %s, which the members do not set and no LimitRange defaults",
+						quota.Name, name))
+				}
+				continue
+			}
+			need, ok := usage[name]
+			if !ok {
+				continue
+			}
+			left := quota.Spec.Hard[name]
+			left.Sub(quota.Status.Used[name])
+			if need.Cmp(left) > 0 {
+				problems = append(problems, fmt.Sprintf("ResourceQuota %q: %s needs %s, %s left",
+					quota.Name, name, need.String(), left.String()))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// quotaUsage adds up what objs count against object count and storage
+// quotas.
+func quotaUsage(objs []*unstructured.Unstructured) coreV1.ResourceList {
+	usage := coreV1.ResourceList{}
+	add := func(name coreV1.ResourceName, quantity resource.Quantity) {
+		total := usage[name]
+		total.Add(quantity)
+		usage[name] = total
+	}
+	one := resource.MustParse("1")
+	for _, o := range objs {
+		gr, ok := kindResources[o.GetKind()]
+		if !ok || o.GetKind() == "Namespace" {
+			continue
+		}
+		add(coreV1.ResourceName("count/"+gr.String()), one)
+		switch o.GetKind() {
+		case "Deployment":
+			replicas, found, _ := unstructured.NestedInt64(o.Object, "spec", "replicas")
+			if !found {
+				replicas = 1
+			}
+			add(coreV1.ResourcePods, *resource.NewQuantity(replicas, resource.DecimalSI))
+		case "Service":
+			add(coreV1.ResourceServices, one)
+		case "Secret":
+			add(coreV1.ResourceSecrets, one)
+		case "ConfigMap":
+			add(coreV1.ResourceConfigMaps, one)
+		case "PersistentVolumeClaim":
+			add(coreV1.ResourcePersistentVolumeClaims, one)
+			size, _, _ := unstructured.NestedString(o.Object, "spec", "resources", "requests", "storage")
+			if quantity, err := resource.ParseQuantity(size); err == nil {
+				add(coreV1.ResourceRequestsStorage, quantity)
+			}
+		}
+	}
+	return usage
+}
+
+// isDefaulted reports whether a LimitRange gives containers a value for the
+// compute quota resource name. A default limit also serves as the request.
+func isDefaulted(limitRanges []coreV1.LimitRange, name coreV1.ResourceName) bool {
+	// Plain cpu and memory are requests too.
+	resourceName, isLimit := name, false
+	if prefix, rest, ok := strings.Cut(string(name), "."); ok {
+		resourceName, isLimit = coreV1.ResourceName(rest), prefix == "limits"
+	}
+	for _, limitRange := range limitRanges {
+		for _, item := range limitRange.Spec.Limits {
+			if item.Type != coreV1.LimitTypeContainer {
+				continue
+			}
+			if _, ok := item.Default[resourceName]; ok {
+				return true
+			}
+			if _, ok := item.DefaultRequest[resourceName]; ok && !isLimit {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/onsi/gomega"
+	authorizationV1 "k8s.io/api/authorization/v1"
+	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+	ctrl "sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlFake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newPreflightProvisioner denies the permissions for which allowed is false.
+func newPreflightProvisioner(allowed func(authorizationV1.ResourceAttributes) bool, objs ...ctrl.Object) *Provisioner {
+	clientSet := fake.NewSimpleClientset()
+	clientSet.PrependReactor("create", "selfsubjectaccessreviews",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8sTesting.CreateAction).GetObject().(*authorizationV1.SelfSubjectAccessReview)
+			review.Status.Allowed = allowed(*review.Spec.ResourceAttributes)
+			return true, review, nil
+		})
+	client := ctrlFake.NewClientBuilder().WithObjects(objs...).Build()
+	return NewProvisioner(NewClients(nil, clientSet, client))
+}
+
+// secretHidingClient may not read Secrets.
+type secretHidingClient struct {
+	ctrl.Client
+}
+
+func (c *secretHidingClient) Get(ctx context.Context, key ctrl.ObjectKey, obj ctrl.Object, opts ...ctrl.GetOption) error {
+	if obj.GetObjectKind().GroupVersionKind().Kind == "Secret" {
+		return apiErrors.NewForbidden(coreV1.Resource("secrets"), key.Name, errors.New("not granted"))
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func TestPreflight(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 3, Probe: DefaultProbeSpec()}
+	allowAll := func(authorizationV1.ResourceAttributes) bool { return true }
+
+	// A missing namespace only needs the permission to create it. Whatever
+	// Apply creates it may roll back.
+	var checked []string
+	provisioner := newPreflightProvisioner(func(attributes authorizationV1.ResourceAttributes) bool {
+		checked = append(checked, attributes.Verb+" "+attributes.Resource)
+		return true
+	})
+	g.Expect(provisioner.Preflight(ctx, spec, ApplyOptions{})).To(gomega.Succeed())
+	g.Expect(checked).To(gomega.Equal([]string{
+		"get namespaces", "get configmaps",
+		"create namespaces", "create configmaps", "delete configmaps", "create secrets", "delete secrets",
+		"create services", "delete services", "create deployments", "delete deployments",
+	}))
+
+	// A kept and resumed run never deletes, but updates the Secrets and
+	// ConfigMaps.
+	checked = nil
+	g.Expect(provisioner.Preflight(ctx, spec, ApplyOptions{OnFailure: FailurePolicyKeep, Resume: true})).To(gomega.Succeed())
+	g.Expect(checked).To(gomega.Equal([]string{
+		"get namespaces", "get configmaps", "create namespaces", "create configmaps", "update configmaps",
+		"create secrets", "get secrets", "update secrets", "create services", "create deployments",
+	}))
+
+	namespace := &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "ns"}}
+	quota := &coreV1.ResourceQuota{
+		ObjectMeta: metaV1.ObjectMeta{Namespace: "ns", Name: "team"},
+		Spec: coreV1.ResourceQuotaSpec{Hard: coreV1.ResourceList{
+			coreV1.ResourcePods:        resource.MustParse("4"),
+			coreV1.ResourceRequestsCPU: resource.MustParse("2"),
+			"count/services":           resource.MustParse("10"),
+		}},
+		Status: coreV1.ResourceQuotaStatus{Used: coreV1.ResourceList{coreV1.ResourcePods: resource.MustParse("2")}},
+	}
+	service := &coreV1.Service{ObjectMeta: metaV1.ObjectMeta{Namespace: "ns", Name: "sample-1"}}
+	provisioner = newPreflightProvisioner(func(attributes authorizationV1.ResourceAttributes) bool {
+		return attributes.Resource != "deployments"
+	}, namespace, quota, service)
+	err := provisioner.Preflight(ctx, spec, ApplyOptions{})
+	var preflightErr *PreflightError
+	g.Expect(errors.As(err, &preflightErr)).To(gomega.BeTrue())
+	g.Expect(preflightErr.Problems).To(gomega.Equal([]string{
+		"missing permission: create deployments.apps in namespace ns",
+		"missing permission: delete deployments.apps in namespace ns",
+		`ResourceQuota "team": pods needs 3, 2 left`,
+		`ResourceQuota "team" limits requests.cpu, which the members do not set and no LimitRange defaults`,
+		`Service "sample-1" already exists`,
+	}))
+
+	// A resumed run keeps existing objects and a LimitRange fills in the
+	// requests.
+	limitRange := &coreV1.LimitRange{
+		ObjectMeta: metaV1.ObjectMeta{Namespace: "ns", Name: "defaults"},
+		Spec: coreV1.LimitRangeSpec{Limits: []coreV1.LimitRangeItem{{
+			Type:    coreV1.LimitTypeContainer,
+			Default: coreV1.ResourceList{coreV1.ResourceCPU: resource.MustParse("500m")},
+		}}},
+	}
+	quota.Status.Used = nil
+	provisioner = newPreflightProvisioner(allowAll, namespace, quota, service, limitRange)
+	g.Expect(provisioner.Preflight(ctx, spec, ApplyOptions{Resume: true})).To(gomega.Succeed())
+
+	// A Secret that may not be read might exist.
+	provisioner = newPreflightProvisioner(allowAll, namespace)
+	provisioner.clients = NewClients(nil, provisioner.clients.GetClientSet(),
+		&secretHidingClient{Client: provisioner.clients.GetControllerClient()})
+	err = provisioner.Preflight(ctx, spec, ApplyOptions{})
+	g.Expect(errors.As(err, &preflightErr)).To(gomega.BeTrue())
+	g.Expect(preflightErr.Problems).To(gomega.HaveLen(3))
+	g.Expect(preflightErr.Problems[0]).To(gomega.HavePrefix(`cannot tell whether Secret "sample-0" exists: `))
+
+	// An invalid spec is reported without asking the cluster.
+	spec.NamePrefix = "1-Sample"
+	err = provisioner.Preflight(ctx, spec, ApplyOptions{})
+	g.Expect(errors.As(err, &preflightErr)).To(gomega.BeTrue())
+	g.Expect(preflightErr.Problems).To(gomega.HaveLen(1))
+	g.Expect(preflightErr.Problems[0]).To(gomega.HavePrefix("metadata.name: Invalid value"))
+}
@@ -0,0 +1,50 @@
+package k8s
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Provisioner deploys, inspects and tears down SSH clusters. Its methods
+// never exit the process, failures are returned as errors: *ValidationError,
+// *TemplateError, *KeyError, *APIError, *ApplyError, *NotReadyError,
+// *RotateError or ErrNoMembers.
+type Provisioner struct {
+	clients     Clients
+	meshChecker MeshChecker
+}
+
+// MeshChecker runs the all-pairs login check of a cluster. A Provisioner is
+// one, it logs in from the member pods.
+type MeshChecker interface {
+	CheckMesh(ctx context.Context, namespace string, namePrefix string) (*MeshReport, error)
+}
+
+// ProvisionerOption customizes a Provisioner.
+type ProvisionerOption func(*Provisioner)
+
+// WithMeshChecker makes RotateKeys verify the mesh with checker.
+func WithMeshChecker(checker MeshChecker) ProvisionerOption {
+	return func(p *Provisioner) {
+		p.meshChecker = checker
+	}
+}
+
+// NewProvisioner returns a Provisioner using the given clients.
+func NewProvisioner(clients Clients, options ...ProvisionerOption) *Provisioner {
+	p := &Provisioner{clients: clients}
+	p.meshChecker = p
+	for _, option := range options {
+		option(p)
+	}
+	return p
+}
+
+// Result describes what Apply did.
+type Result struct {
+	// Created are the objects created, in creation order.
+	Created []*unstructured.Unstructured
+	// Existing are the objects that already existed and were kept.
+	Existing []*unstructured.Unstructured
+}
@@ -0,0 +1,304 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	ctrl "sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlFake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newFakeProvisioner(objs ...ctrl.Object) (*Provisioner, ctrl.Client) {
+	client := ctrlFake.NewClientBuilder().WithObjects(objs...).Build()
+	return NewProvisioner(NewClients(nil, fake.NewSimpleClientset(), client)), client
+}
+
+func kindsOf(objs []*unstructured.Unstructured) []string {
+	kinds := []string{}
+	for _, o := range objs {
+		kinds = append(kinds, o.GetKind()+"/"+o.GetName())
+	}
+	return kinds
+}
+
+func TestProvisionerApply(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, _ := newFakeProvisioner()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+
+	result, err := provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(result.Created)).To(gomega.Equal([]string{
+		"Namespace/ns", "ConfigMap/sample-cluster", "ConfigMap/" + bootstraptConfigMapName(podBootstrapt),
+		"ConfigMap/sample-users", "ConfigMap/sample-revoked", "Secret/sample-0", "Service/sample-0",
+		"Deployment/sample-0",
+	}))
+
+	// The shared objects may exist, the member objects may not.
+	_, err = provisioner.Apply(ctx, spec, ApplyOptions{})
+	var apiErr *APIError
+	g.Expect(errors.As(err, &apiErr)).To(gomega.BeTrue())
+	g.Expect(apiErr.Kind).To(gomega.Equal("ConfigMap"))
+	g.Expect(apiErr.Name).To(gomega.Equal("sample-cluster"))
+	g.Expect(apiErrors.IsAlreadyExists(err)).To(gomega.BeTrue())
+
+	g.Expect(provisioner.Delete(ctx, spec)).To(gomega.Succeed())
+
+	spec.PodNum = 0
+	_, err = provisioner.Apply(ctx, spec, ApplyOptions{})
+	var validationErr *ValidationError
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+}
+
+func TestProvisionerDeleteRetention(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	pvc := &coreV1.PersistentVolumeClaim{ObjectMeta: metaV1.ObjectMeta{Namespace: "ns", Name: "sample-0-home"}}
+	provisioner, client := newFakeProvisioner(pvc)
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+	key := types.NamespacedName{Namespace: "ns", Name: "sample-0-home"}
+
+	// Without persistence the PVCs of an earlier deploy are kept by default.
+	g.Expect(provisioner.Delete(ctx, spec)).To(gomega.Succeed())
+	g.Expect(client.Get(ctx, key, &coreV1.PersistentVolumeClaim{})).To(gomega.Succeed())
+
+	spec.Persistence.RetentionPolicy = RetentionPolicyDelete
+	g.Expect(provisioner.Delete(ctx, spec)).To(gomega.Succeed())
+	g.Expect(apiErrors.IsNotFound(client.Get(ctx, key, &coreV1.PersistentVolumeClaim{}))).To(gomega.BeTrue())
+
+	spec.Persistence.RetentionPolicy = "forever"
+	var validationErr *ValidationError
+	g.Expect(errors.As(provisioner.Delete(ctx, spec), &validationErr)).To(gomega.BeTrue())
+}
+
+func TestProvisionerApplyRollback(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	taken := &coreV1.Service{ObjectMeta: metaV1.ObjectMeta{Namespace: "ns", Name: "sample-1"}}
+	provisioner, client := newFakeProvisioner(taken)
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 2, Probe: DefaultProbeSpec()}
+
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{})
+	var applyErr *ApplyError
+	g.Expect(errors.As(err, &applyErr)).To(gomega.BeTrue())
+	g.Expect(applyErr.Failed.GetName()).To(gomega.Equal("sample-1"))
+	g.Expect(applyErr.Created).To(gomega.BeEmpty())
+	g.Expect(kindsOf(applyErr.RolledBack)).To(gomega.Equal([]string{
+		"Service/sample-0", "Secret/sample-1", "Secret/sample-0", "ConfigMap/sample-revoked", "ConfigMap/sample-users",
+		"ConfigMap/sample-cluster",
+	}))
+	// The shared objects may be in use by others by now.
+	g.Expect(kindsOf(applyErr.Kept)).To(gomega.Equal([]string{
+		"Namespace/ns", "ConfigMap/" + bootstraptConfigMapName(podBootstrapt),
+	}))
+	g.Expect(client.Get(ctx, types.NamespacedName{Name: "ns"}, &coreV1.Namespace{})).To(gomega.Succeed())
+	g.Expect(kindsOf(applyErr.Pending)).To(gomega.Equal([]string{"Deployment/sample-0", "Deployment/sample-1"}))
+	err = client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-0"}, &coreV1.Secret{})
+	g.Expect(apiErrors.IsNotFound(err)).To(gomega.BeTrue())
+}
+
+func TestProvisionerApplyBootstraptScripts(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	// A cluster with its own script does not reuse the shared ConfigMap of
+	// the embedded one, and its members mount their own.
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"custom\"\n"
+	g.Expect(os.WriteFile(filepath.Join(dir, bootstraptTemplate), []byte(script), 0600)).To(gomega.Succeed())
+	other := ClusterSpec{Namespace: "ns", NamePrefix: "other", PodNum: 1, Probe: DefaultProbeSpec(), TemplatesDir: dir}
+	result, err := provisioner.Apply(ctx, other, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	name := bootstraptConfigMapName(script)
+	g.Expect(kindsOf(result.Created)).To(gomega.ContainElement("ConfigMap/" + name))
+	configMap := &coreV1.ConfigMap{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: name}, configMap)).To(gomega.Succeed())
+	g.Expect(configMap.Data[bootstraptKey]).To(gomega.Equal(script))
+	deploy := &appsV1.Deployment{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "other-0"}, deploy)).To(gomega.Succeed())
+	g.Expect(deploy.Spec.Template.Spec.Volumes).To(gomega.ContainElement(
+		gomega.HaveField("ConfigMap.Name", name)))
+
+	// The embedded script is left to the clusters running it.
+	shared := &coreV1.ConfigMap{}
+	key := types.NamespacedName{Namespace: "ns", Name: bootstraptConfigMapName(podBootstrapt)}
+	g.Expect(client.Get(ctx, key, shared)).To(gomega.Succeed())
+	g.Expect(shared.Data[bootstraptKey]).To(gomega.Equal(podBootstrapt))
+}
+
+func TestProvisionerApplyResume(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 2, Probe: DefaultProbeSpec()}
+
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{OnFailure: FailurePolicyKeep})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	before := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-0"}, before)).To(gomega.Succeed())
+	deploy := &appsV1.Deployment{ObjectMeta: metaV1.ObjectMeta{Namespace: "ns", Name: "sample-1"}}
+	g.Expect(client.Delete(ctx, deploy)).To(gomega.Succeed())
+
+	result, err := provisioner.Apply(ctx, spec, ApplyOptions{Resume: true})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(result.Created)).To(gomega.Equal([]string{"Deployment/sample-1"}))
+	after := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-0"}, after)).To(gomega.Succeed())
+	g.Expect(after.Data).To(gomega.Equal(before.Data))
+}
+
+func TestProvisionerApplyResumeMissingSecret(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 2, Probe: DefaultProbeSpec()}
+
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{OnFailure: FailurePolicyKeep})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	before := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-0"}, before)).To(gomega.Succeed())
+	missing := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-1"}, missing)).To(gomega.Succeed())
+	g.Expect(client.Delete(ctx, missing)).To(gomega.Succeed())
+
+	result, err := provisioner.Apply(ctx, spec, ApplyOptions{Resume: true})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(result.Created)).To(gomega.Equal([]string{"Secret/sample-1"}))
+	// sample-0 keeps its keys and trusts the new key of sample-1.
+	after := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-0"}, after)).To(gomega.Succeed())
+	g.Expect(after.Data["id_rsa"]).To(gomega.Equal(before.Data["id_rsa"]))
+	g.Expect(after.Data[hostKeyKey]).To(gomega.Equal(before.Data[hostKeyKey]))
+	regenerated := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-1"}, regenerated)).To(gomega.Succeed())
+	g.Expect(regenerated.Data["id_rsa"]).NotTo(gomega.Equal(missing.Data["id_rsa"]))
+	g.Expect(string(after.Data["authorized_keys"])).To(gomega.ContainSubstring(string(regenerated.Data["id_rsa.pub"])))
+	g.Expect(string(after.Data["authorized_keys"])).NotTo(gomega.ContainSubstring(string(missing.Data["id_rsa.pub"])))
+}
+
+// throttlingClient rejects the first create of every object as throttled.
+type throttlingClient struct {
+	ctrl.Client
+	mu        sync.Mutex
+	throttled map[string]bool
+}
+
+func (c *throttlingClient) Create(ctx context.Context, obj ctrl.Object, opts ...ctrl.CreateOption) error {
+	c.mu.Lock()
+	key := obj.GetObjectKind().GroupVersionKind().Kind + "/" + obj.GetName()
+	first := !c.throttled[key]
+	c.throttled[key] = true
+	c.mu.Unlock()
+	if first {
+		return apiErrors.NewTooManyRequests("throttled", 0)
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestRetryWriteRetryAfter(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	writes := 0
+	start := time.Now()
+	err := retryWrite(ctx, func() error {
+		writes++
+		if writes == 1 {
+			return apiErrors.NewTooManyRequests("throttled", 1)
+		}
+		return nil
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(writes).To(gomega.Equal(2))
+	// The server asked for a second, much longer than the first backoff step.
+	g.Expect(time.Since(start)).To(gomega.BeNumerically(">=", time.Second))
+
+	writes = 0
+	err = retryWrite(ctx, func() error {
+		writes++
+		return apiErrors.NewServiceUnavailable("down")
+	})
+	g.Expect(apiErrors.IsServiceUnavailable(err)).To(gomega.BeTrue())
+	g.Expect(writes).To(gomega.Equal(4))
+}
+
+// namespaceForbiddingClient may not create namespaces, like the controller
+// of a namespaced install.
+type namespaceForbiddingClient struct {
+	ctrl.Client
+}
+
+func (c *namespaceForbiddingClient) Create(ctx context.Context, obj ctrl.Object, opts ...ctrl.CreateOption) error {
+	if obj.GetObjectKind().GroupVersionKind().Kind == "Namespace" {
+		return apiErrors.NewForbidden(coreV1.Resource("namespaces"), obj.GetName(), errors.New("not granted"))
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestProvisionerApplyAssumeNamespace(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	client := &namespaceForbiddingClient{Client: ctrlFake.NewClientBuilder().Build()}
+	provisioner := NewProvisioner(NewClients(nil, fake.NewSimpleClientset(), client))
+	namespace := &unstructured.Unstructured{}
+	namespace.SetAPIVersion("v1")
+	namespace.SetKind("Namespace")
+	namespace.SetName("ns")
+
+	// Someone running deploy learns they may not create the namespace.
+	_, err := provisioner.create(ctx, namespace, ApplyOptions{})
+	g.Expect(apiErrors.IsForbidden(err)).To(gomega.BeTrue())
+	var apiErr *APIError
+	g.Expect(errors.As(err, &apiErr)).To(gomega.BeTrue())
+
+	existing, err := provisioner.create(ctx, namespace, ApplyOptions{AssumeNamespace: true})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(existing).To(gomega.BeTrue())
+}
+
+func TestProvisionerApplyConcurrent(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	client := &throttlingClient{
+		Client:    ctrlFake.NewClientBuilder().Build(),
+		throttled: map[string]bool{},
+	}
+	provisioner := NewProvisioner(NewClients(nil, fake.NewSimpleClientset(), client))
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 3, Probe: DefaultProbeSpec()}
+
+	result, err := provisioner.Apply(ctx, spec, ApplyOptions{Workers: 4})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(result.Created)).To(gomega.Equal([]string{
+		"Namespace/ns", "ConfigMap/sample-cluster", "ConfigMap/" + bootstraptConfigMapName(podBootstrapt),
+		"ConfigMap/sample-users", "ConfigMap/sample-revoked", "Secret/sample-0", "Secret/sample-1", "Secret/sample-2",
+		"Service/sample-0", "Service/sample-1", "Service/sample-2",
+		"Deployment/sample-0", "Deployment/sample-1", "Deployment/sample-2",
+	}))
+	g.Expect(client.throttled).To(gomega.HaveLen(len(result.Created)))
+
+	// Every member gets a distinct key.
+	seen := map[string]bool{}
+	for _, name := range memberNames(spec) {
+		secret := &coreV1.Secret{}
+		g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: name}, secret)).To(gomega.Succeed())
+		seen[string(secret.Data["id_rsa.pub"])] = true
+	}
+	g.Expect(seen).To(gomega.HaveLen(spec.PodNum))
+}
@@ -0,0 +1,289 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// revokedKeysKey of the revoked ConfigMap is the RevokedKeys file of
+	// sshd. The members mount it at revokedKeysPath, which sshd reads on
+	// every login.
+	revokedKeysKey  = "revoked_keys"
+	revokedKeysPath = "/etc/kssh/revoked/" + revokedKeysKey
+)
+
+func revokedConfigMapName(spec ClusterSpec) string {
+	return spec.NamePrefix + "-revoked"
+}
+
+// isRevokedConfigMap reports whether an object holds the revoked keys of its
+// cluster.
+func isRevokedConfigMap(o *coreV1.ConfigMap) bool {
+	return o.Name == revokedConfigMapName(ClusterSpec{NamePrefix: o.Labels[clusterLabel]})
+}
+
+// RevokedKey is a key no member of a cluster accepts anymore.
+type RevokedKey struct {
+	// Name is the member or user the key belonged to.
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+	RevokedAt   string `json:"revokedAt,omitempty"`
+}
+
+// RevokeOptions names what Revoke revokes: the key of a member, other keys
+// in authorized_keys format, or both.
+type RevokeOptions struct {
+	Member string
+	// Keys are authorized_keys lines, recorded as revoked from Name.
+	Keys []string
+	Name string
+}
+
+// Revoke removes keys from every trust set of a cluster: the authorized_keys
+// of the member Secrets and the users ConfigMap, login users included. It
+// records them in the revoked ConfigMap, which the members pass to sshd as
+// RevokedKeys, so a running member refuses them once kubelet has updated its
+// mount, without being restarted. Apply, SyncUsers and RotateKeys never add a
+// recorded key back. Revoking the key of a member locks it out of the others;
+// `keys rotate` gives it a new one.
+func (p *Provisioner) Revoke(
+	ctx context.Context,
+	spec ClusterSpec,
+	options RevokeOptions) ([]RevokedKey, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	keys, err := p.keysToRevoke(ctx, spec, options)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := p.revokedKeys(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, key := range keys {
+		if isRevoked(key.key, revoked) {
+			glog.Infof("key %s of %q is already revoked", key.Fingerprint, key.Name)
+			continue
+		}
+		revoked = append(revoked, fmt.Sprintf("%s %s %s\n",
+			bytes.TrimSpace(ssh.MarshalAuthorizedKey(key.key)), key.Name, now)...)
+	}
+
+	// The record comes first, it is what sshd enforces.
+	objs, err := generateUsersObjs(spec, nil, revoked)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objs {
+		if o.GetKind() == "ConfigMap" && o.GetName() == revokedConfigMapName(spec) {
+			if err := p.createOrUpdate(ctx, o); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, name := range memberNames(spec) {
+		if err := p.removeRevoked(ctx, spec, &coreV1.Secret{}, name, revoked); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.removeRevoked(ctx, spec, &coreV1.ConfigMap{}, usersConfigMapName(spec), revoked); err != nil {
+		return nil, err
+	}
+
+	result := make([]RevokedKey, 0, len(keys))
+	for _, key := range keys {
+		glog.Infof("revoked key %s of %q", key.Fingerprint, key.Name)
+		result = append(result, key.RevokedKey)
+	}
+	return result, nil
+}
+
+type keyToRevoke struct {
+	RevokedKey
+	key ssh.PublicKey
+}
+
+// keysToRevoke resolves the options to public keys.
+func (p *Provisioner) keysToRevoke(
+	ctx context.Context,
+	spec ClusterSpec,
+	options RevokeOptions) ([]keyToRevoke, error) {
+	errs := field.ErrorList{}
+	if options.Member == "" && len(options.Keys) == 0 {
+		errs = append(errs, field.Required(field.NewPath("member"), "or keys"))
+	}
+	if options.Member != "" && !contains(memberNames(spec), options.Member) {
+		errs = append(errs, field.NotFound(field.NewPath("member"), options.Member))
+	}
+	if len(options.Keys) != 0 && strings.ContainsAny(options.Name, " \t\n") {
+		errs = append(errs, field.Invalid(field.NewPath("name"), options.Name, "must not contain whitespace"))
+	}
+	if len(errs) != 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+
+	var keys []keyToRevoke
+	add := func(name string, line []byte) error {
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return &KeyError{Err: fmt.Errorf("failed to parse key of %q: %w", name, err)}
+		}
+		keys = append(keys, keyToRevoke{
+			RevokedKey: RevokedKey{Name: name, Fingerprint: ssh.FingerprintSHA256(key)},
+			key:        key,
+		})
+		return nil
+	}
+	if options.Member != "" {
+		secret := &coreV1.Secret{}
+		key := types.NamespacedName{Namespace: spec.Namespace, Name: options.Member}
+		if err := p.clients.GetControllerClient().Get(ctx, key, secret); err != nil {
+			return nil, &APIError{Verb: "get", Kind: "Secret", Name: options.Member, Err: err}
+		}
+		if err := add(options.Member, secret.Data["id_rsa.pub"]); err != nil {
+			return nil, err
+		}
+	}
+	name := options.Name
+	if name == "" {
+		name = "unknown"
+	}
+	for _, line := range options.Keys {
+		if err := add(name, []byte(line)); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// revokedKeys returns the RevokedKeys file of a cluster, empty when nothing
+// was revoked yet.
+func (p *Provisioner) revokedKeys(ctx context.Context, spec ClusterSpec) ([]byte, error) {
+	configMap := &coreV1.ConfigMap{}
+	key := types.NamespacedName{Namespace: spec.Namespace, Name: revokedConfigMapName(spec)}
+	err := p.clients.GetControllerClient().Get(ctx, key, configMap)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &APIError{Verb: "get", Kind: "ConfigMap", Name: key.Name, Err: err}
+	}
+	return []byte(configMap.Data[revokedKeysKey]), nil
+}
+
+// removeRevoked drops the revoked keys from the authorized_keys of a live
+// member Secret or from every file of the users ConfigMap. A missing object
+// has nothing to drop.
+func (p *Provisioner) removeRevoked(
+	ctx context.Context,
+	spec ClusterSpec,
+	obj ctrl.Object,
+	name string,
+	revoked []byte) error {
+	client := p.clients.GetControllerClient()
+	key := types.NamespacedName{Namespace: spec.Namespace, Name: name}
+	kind := "Secret"
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := client.Get(ctx, key, obj); err != nil {
+			return err
+		}
+		switch o := obj.(type) {
+		case *coreV1.Secret:
+			if o.Data == nil {
+				return nil
+			}
+			o.Data["authorized_keys"] = removeKeys(o.Data["authorized_keys"], revoked)
+		case *coreV1.ConfigMap:
+			kind = "ConfigMap"
+			if o.Data == nil {
+				return nil
+			}
+			// Besides the users file, login-users.sh lists the keys of
+			// the login users one per line.
+			for file, content := range o.Data {
+				o.Data[file] = string(removeKeys([]byte(content), revoked))
+			}
+		}
+		return client.Update(ctx, obj)
+	})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return &APIError{Verb: "update", Kind: kind, Name: name, Err: err}
+	}
+	return nil
+}
+
+// removeKeys drops the lines of an authorized_keys content whose key is in
+// revoked, whatever their options and comments. Other lines are kept as
+// they are.
+func removeKeys(content []byte, revoked []byte) []byte {
+	if len(revoked) == 0 {
+		return content
+	}
+	var b bytes.Buffer
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil && isRevoked(key, revoked) {
+			continue
+		}
+		b.WriteString(line)
+	}
+	return b.Bytes()
+}
+
+// isRevoked reports whether a key is listed in a RevokedKeys file.
+func isRevoked(key ssh.PublicKey, revoked []byte) bool {
+	for _, entry := range parseRevokedKeys(revoked) {
+		if bytes.Equal(entry.key.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRevokedKeys reads a RevokedKeys file as Revoke writes it: one
+// "<key> <name> <time>" line per key.
+func parseRevokedKeys(revoked []byte) []keyToRevoke {
+	var keys []keyToRevoke
+	for len(revoked) != 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(revoked)
+		if err != nil {
+			break
+		}
+		revoked = rest
+		entry := keyToRevoke{RevokedKey: RevokedKey{Fingerprint: ssh.FingerprintSHA256(key)}, key: key}
+		if fields := strings.Fields(comment); len(fields) != 0 {
+			entry.Name = fields[0]
+			if len(fields) > 1 {
+				entry.RevokedAt = fields[1]
+			}
+		}
+		keys = append(keys, entry)
+	}
+	return keys
+}
@@ -0,0 +1,171 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	ctrlFake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRemoveKeys(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	_, revokedKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	_, keptKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	revoked := strings.TrimSpace(string(revokedKey))
+	kept := strings.TrimSpace(string(keptKey))
+
+	content := "# alice\n" + `from="10.0.0.0/8" ` + revoked + " alice@laptop\n" + kept + "\n"
+	g.Expect(string(removeKeys([]byte(content), []byte(revoked+" alice 2026-01-01T00:00:00Z\n")))).
+		To(gomega.Equal("# alice\n" + kept + "\n"))
+	g.Expect(removeKeys([]byte(content), nil)).To(gomega.Equal([]byte(content)))
+}
+
+func TestRevoke(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	_, userKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 2, Probe: DefaultProbeSpec()}
+	spec.Users = []UserKeySpec{{Name: "alice", Key: strings.TrimSpace(string(userKey))}}
+	_, err = provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	getSecret := func(name string) *coreV1.Secret {
+		secret := &coreV1.Secret{}
+		g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: name}, secret)).To(gomega.Succeed())
+		return secret
+	}
+	getConfigMap := func(name string) *coreV1.ConfigMap {
+		configMap := &coreV1.ConfigMap{}
+		g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: name}, configMap)).To(gomega.Succeed())
+		return configMap
+	}
+	memberKey := strings.TrimSpace(string(getSecret("sample-1").Data["id_rsa.pub"]))
+	g.Expect(string(getSecret("sample-0").Data["authorized_keys"])).To(gomega.ContainSubstring(memberKey))
+	g.Expect(getConfigMap("sample-revoked").Data).To(gomega.HaveKeyWithValue(revokedKeysKey, ""))
+
+	revoked, err := provisioner.Revoke(ctx, spec, RevokeOptions{
+		Member: "sample-1",
+		Keys:   []string{string(userKey)},
+		Name:   "alice",
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(revoked).To(gomega.HaveLen(2))
+	g.Expect(revoked[0].Name).To(gomega.Equal("sample-1"))
+	g.Expect(revoked[1].Name).To(gomega.Equal("alice"))
+
+	// Nothing trusts the keys anymore, and reconciling does not add them back.
+	check := func() {
+		for _, name := range memberNames(spec) {
+			g.Expect(string(getSecret(name).Data["authorized_keys"])).NotTo(gomega.ContainSubstring(memberKey))
+		}
+		g.Expect(getConfigMap("sample-users").Data["root"]).NotTo(gomega.ContainSubstring(string(userKey)))
+		record := getConfigMap("sample-revoked").Data[revokedKeysKey]
+		g.Expect(parseRevokedKeys([]byte(record))).To(gomega.HaveLen(2))
+		g.Expect(record).To(gomega.ContainSubstring(memberKey + " sample-1 "))
+	}
+	check()
+	_, err = provisioner.Apply(ctx, spec, ApplyOptions{Resume: true})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	check()
+	g.Expect(provisioner.SyncUsers(ctx, spec)).To(gomega.Succeed())
+	check()
+	_, err = provisioner.Revoke(ctx, spec, RevokeOptions{Member: "sample-1"})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	check()
+
+	_, err = provisioner.Revoke(ctx, spec, RevokeOptions{Member: "sample-7"})
+	var validationErr *ValidationError
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+}
+
+func TestRevokeLoginUsers(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	_, revokedKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	_, keptKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	revokedLine := strings.TrimSpace(string(revokedKey))
+	keptLine := strings.TrimSpace(string(keptKey))
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+	spec.LoginUsers = []LoginUserSpec{{Name: "alice", AuthorizedKeys: []string{revokedLine, keptLine}}}
+	_, err = provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	script := func() string {
+		configMap := &coreV1.ConfigMap{}
+		g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-users"}, configMap)).To(gomega.Succeed())
+		return configMap.Data["login-users.sh"]
+	}
+	g.Expect(script()).To(gomega.ContainSubstring(revokedLine))
+
+	_, err = provisioner.Revoke(ctx, spec, RevokeOptions{Keys: []string{revokedLine}, Name: "alice"})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	for _, reconcile := range []func() error{
+		func() error { return nil },
+		func() error { _, err := provisioner.Apply(ctx, spec, ApplyOptions{Resume: true}); return err },
+		func() error { return provisioner.SyncUsers(ctx, spec) },
+	} {
+		g.Expect(reconcile()).To(gomega.Succeed())
+		g.Expect(script()).NotTo(gomega.ContainSubstring(revokedLine))
+		g.Expect(script()).To(gomega.ContainSubstring(keptLine))
+	}
+}
+
+func TestStatusRevokedKeys(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	_, publicKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	key, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	meta := func(name string) metaV1.ObjectMeta {
+		return metaV1.ObjectMeta{Namespace: "ns", Name: name, Labels: map[string]string{clusterLabel: "sample"}}
+	}
+	clientSet := fake.NewSimpleClientset(
+		&appsV1.Deployment{ObjectMeta: meta("sample-0")},
+		&coreV1.ConfigMap{
+			ObjectMeta: meta("sample-revoked"),
+			Data: map[string]string{
+				revokedKeysKey: strings.TrimSpace(string(publicKey)) + " sample-1 2026-01-01T00:00:00Z\n",
+			},
+		},
+		&coreV1.ConfigMap{
+			ObjectMeta: meta("sample-users"),
+			Data:       map[string]string{"authorized_keys": string(publicKey)},
+		})
+	provisioner := NewProvisioner(NewClients(nil, clientSet, ctrlFake.NewClientBuilder().Build()))
+	statuses, err := provisioner.Status(ctx, "ns", "sample")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(statuses).To(gomega.HaveLen(1))
+	g.Expect(statuses[0].RevokedKeys).To(gomega.Equal([]RevokedKey{{
+		Name:        "sample-1",
+		Fingerprint: ssh.FingerprintSHA256(key),
+		RevokedAt:   "2026-01-01T00:00:00Z",
+	}}))
+
+	for _, output := range []string{"table", "json", "yaml"} {
+		var buf bytes.Buffer
+		g.Expect(PrintStatus(&buf, statuses, output)).To(gomega.Succeed())
+		g.Expect(buf.String()).To(gomega.ContainSubstring(ssh.FingerprintSHA256(key)), output)
+		if output == "table" {
+			g.Expect(buf.String()).To(gomega.MatchRegexp(`(?m)^sample +sample-1 +SHA256:\S+ +2026-01-01T00:00:00Z$`))
+		}
+	}
+}
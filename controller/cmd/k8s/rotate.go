@@ -0,0 +1,410 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// keysVersionAnnotation on the pod template of a member is a digest of
+	// its Secret, changing it rolls the Secret into a new pod.
+	keysVersionAnnotation = "ssh.zicongmei.github.io/keys-version"
+	// keysRotatedAtAnnotation on a member Secret is when its key was last
+	// replaced.
+	keysRotatedAtAnnotation = "ssh.zicongmei.github.io/keys-rotated-at"
+	rolloutPollInterval     = 2 * time.Second
+	// rotateRetryInterval is how long a scheduled rotation waits after a
+	// failure before it tries again.
+	rotateRetryInterval = time.Hour
+)
+
+// RotateStage is one step of a key rotation.
+type RotateStage string
+
+const (
+	// RotateStageTrust adds the new public keys to authorized_keys next to
+	// the old ones.
+	RotateStageTrust RotateStage = "trust"
+	// RotateStageSwitch replaces the private keys of the members.
+	RotateStageSwitch RotateStage = "switch"
+	// RotateStagePrune removes the old public keys from authorized_keys.
+	RotateStagePrune RotateStage = "prune"
+)
+
+// RotateOptions tunes a single RotateKeys run.
+type RotateOptions struct {
+	// Parallel is the number of members restarted at once, 1 if unset.
+	Parallel int
+	// Timeout bounds the rollout of each member, 0 means no limit.
+	Timeout time.Duration
+	// Workers generate the new keys, DefaultWorkers if unset.
+	Workers int
+}
+
+func (o RotateOptions) parallel() int {
+	if o.Parallel < 1 {
+		return 1
+	}
+	return o.Parallel
+}
+
+func (o RotateOptions) workers() int {
+	if o.Workers < 1 {
+		return DefaultWorkers
+	}
+	return o.Workers
+}
+
+// rotateStep is what the member Secrets hold after one stage.
+type rotateStep struct {
+	stage       RotateStage
+	privateKeys [][]byte
+	publicKeys  [][]byte
+	authorized  []byte
+}
+
+// rotateSteps moves the members from the old to the new keys such that every
+// member trusts the key every other member presents at any time, also while
+// only some of them have restarted.
+func rotateSteps(old *sshKeys, fresh *sshKeys, trustedKeys []byte) []rotateStep {
+	both := joinKeys(old.authorizedHosts, fresh.authorizedHosts, trustedKeys)
+	return []rotateStep{
+		{RotateStageTrust, old.allPrivateKeys, old.allPublicKeys, both},
+		{RotateStageSwitch, fresh.allPrivateKeys, fresh.allPublicKeys, both},
+		{RotateStagePrune, fresh.allPrivateKeys, fresh.allPublicKeys, joinKeys(fresh.authorizedHosts, trustedKeys)},
+	}
+}
+
+// joinKeys concatenates authorized_keys contents, dropping repeated lines.
+// Imported member keys are the same before and after a rotation.
+func joinKeys(contents ...[]byte) []byte {
+	var b bytes.Buffer
+	seen := map[string]bool{}
+	for _, content := range contents {
+		for _, line := range strings.Split(string(content), "\n") {
+			if line == "" || seen[line] {
+				continue
+			}
+			seen[line] = true
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// RotateKeys replaces the key pair of every member without a moment in which
+// two members reject each other. It first makes every member trust the old
+// and the new keys, then rolls the new private keys into the pods and only
+// drops the old keys once all members can log in to each other. Every stage
+// restarts the members, Parallel at a time, and ends with the all-pairs
+// check, which revoked members only have to pass once they have a new key.
+// Members whose key spec.Keys imports keep it, so it must not be revoked.
+func (p *Provisioner) RotateKeys(
+	ctx context.Context,
+	spec ClusterSpec,
+	options RotateOptions) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	old, err := p.loadSSHKeys(ctx, spec)
+	if err != nil {
+		return err
+	}
+	fresh, err := generateSSHKeys(ctx, spec, options.workers())
+	if err != nil {
+		return err
+	}
+	trustedKeys, err := readTrustedKeys(spec.Keys.TrustedKeys)
+	if err != nil {
+		return err
+	}
+	revokedKeys, err := p.revokedKeys(ctx, spec)
+	if err != nil {
+		return err
+	}
+	revokedMembers, err := revokedMembers(spec, old, fresh, revokedKeys)
+	if err != nil {
+		return err
+	}
+	for _, step := range rotateSteps(old, fresh, trustedKeys) {
+		step.authorized = removeKeys(step.authorized, revokedKeys)
+		glog.Infof("rotating the keys of %q: %s", spec.NamePrefix, step.stage)
+		if err := p.rollKeys(ctx, spec, step, options); err != nil {
+			return &RotateError{Stage: step.stage, Err: err}
+		}
+		// Revoked members still present their old key until the switch.
+		lockedOut := revokedMembers
+		if step.stage != RotateStageTrust {
+			lockedOut = nil
+		}
+		if err := p.verifyMesh(ctx, spec, lockedOut); err != nil {
+			return &RotateError{Stage: step.stage, Err: err}
+		}
+	}
+	glog.Infof("rotated the keys of %d members of %q", spec.PodNum, spec.NamePrefix)
+	return nil
+}
+
+// revokedMembers returns the members whose current key is revoked. They
+// cannot log in to the others until the new keys are switched in, which
+// never happens for an imported key.
+func revokedMembers(spec ClusterSpec, old *sshKeys, fresh *sshKeys, revokedKeys []byte) (map[string]bool, error) {
+	members := map[string]bool{}
+	for i, name := range memberNames(spec) {
+		if len(removeKeys(old.allPublicKeys[i], revokedKeys)) != 0 {
+			continue
+		}
+		if bytes.Equal(old.allPublicKeys[i], fresh.allPublicKeys[i]) {
+			return nil, &KeyError{Err: fmt.Errorf("the imported key of %q is revoked, import a new one", name)}
+		}
+		members[name] = true
+	}
+	return members, nil
+}
+
+// rollKeys writes one step to the member Secrets and restarts the members,
+// Parallel at a time.
+func (p *Provisioner) rollKeys(
+	ctx context.Context,
+	spec ClusterSpec,
+	step rotateStep,
+	options RotateOptions) error {
+	members := memberNames(spec)
+	errs := make([]error, len(members))
+	workqueue.ParallelizeUntil(ctx, options.parallel(), len(members), func(i int) {
+		errs[i] = p.rollMember(ctx, spec, members[i], i, step, options.Timeout)
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollMember writes the keys of one member to its Secret and waits for its
+// Deployment to roll them out. A Secret that already holds them restarts
+// nothing. The switch stage stamps the Secret with the rotation time, also
+// when the key is imported and stays the same.
+func (p *Provisioner) rollMember(
+	ctx context.Context,
+	spec ClusterSpec,
+	name string,
+	index int,
+	step rotateStep,
+	timeout time.Duration) error {
+	client := p.clients.GetControllerClient()
+	key := types.NamespacedName{Namespace: spec.Namespace, Name: name}
+	var version string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret := &coreV1.Secret{}
+		if err := client.Get(ctx, key, secret); err != nil {
+			return err
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		if step.stage == RotateStageSwitch {
+			metaV1.SetMetaDataAnnotation(&secret.ObjectMeta, keysRotatedAtAnnotation,
+				time.Now().UTC().Format(time.RFC3339))
+		}
+		secret.Data["id_rsa"] = step.privateKeys[index]
+		secret.Data["id_rsa.pub"] = step.publicKeys[index]
+		secret.Data["authorized_keys"] = step.authorized
+		version = keysVersion(secret.Data)
+		return client.Update(ctx, secret)
+	})
+	if err != nil {
+		return &APIError{Verb: "update", Kind: "Secret", Name: name, Err: err}
+	}
+
+	deploy := &appsV1.Deployment{ObjectMeta: metaV1.ObjectMeta{Namespace: spec.Namespace, Name: name}}
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+		keysVersionAnnotation, version)
+	if err := client.Patch(ctx, deploy, ctrl.RawPatch(types.StrategicMergePatchType, []byte(patch))); err != nil {
+		return &APIError{Verb: "patch", Kind: "Deployment", Name: name, Err: err}
+	}
+	return p.waitForRollout(ctx, spec, deploy, timeout)
+}
+
+// keysVersion is a short digest of the keys a member Secret holds.
+func keysVersion(data map[string][]byte) string {
+	h := sha256.New()
+	for _, key := range []string{"id_rsa", "id_rsa.pub", "authorized_keys"} {
+		h.Write(data[key])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// waitForRollout waits until every pod of a Deployment runs its current
+// template and is available. On timeout it returns a *NotReadyError
+// explaining why the newest pod is not ready.
+func (p *Provisioner) waitForRollout(
+	ctx context.Context,
+	spec ClusterSpec,
+	deploy *appsV1.Deployment,
+	timeout time.Duration) error {
+	client := p.clients.GetControllerClient()
+	key := types.NamespacedName{Namespace: deploy.Namespace, Name: deploy.Name}
+	generation := deploy.Generation
+	err := wait.PollImmediateWithContext(ctx, rolloutPollInterval, timeout, func(ctx context.Context) (bool, error) {
+		if err := client.Get(ctx, key, deploy); err != nil {
+			return false, &APIError{Verb: "get", Kind: "Deployment", Name: deploy.Name, Err: err}
+		}
+		return rolledOut(deploy, generation), nil
+	})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if !errors.Is(err, wait.ErrWaitTimeout) {
+		return err
+	}
+
+	diagnoseCtx, cancel := context.WithTimeout(ctx, diagnoseTimeout)
+	defer cancel()
+	cs := p.clients.GetClientSet()
+	list, err := cs.CoreV1().Pods(deploy.Namespace).List(diagnoseCtx, metaV1.ListOptions{
+		LabelSelector: memberLabel + "=" + deploy.Name,
+	})
+	if err != nil {
+		return &APIError{Verb: "list", Kind: "Pod", Err: err}
+	}
+	pods := map[string]*coreV1.Pod{}
+	for i := range list.Items {
+		pods[list.Items[i].Name] = &list.Items[i]
+	}
+	return &NotReadyError{
+		Cluster: spec.NamePrefix,
+		Timeout: timeout,
+		Diagnoses: map[string]string{
+			deploy.Name: diagnoseMember(diagnoseCtx, cs, deploy.Namespace, podsByMember(pods)[deploy.Name]),
+		},
+	}
+}
+
+// rolledOut reports whether a Deployment has rolled out the template of the
+// given generation: only updated pods are left and all of them are available.
+func rolledOut(deploy *appsV1.Deployment, generation int64) bool {
+	replicas := int32(1)
+	if deploy.Spec.Replicas != nil {
+		replicas = *deploy.Spec.Replicas
+	}
+	status := deploy.Status
+	return status.ObservedGeneration >= generation &&
+		status.UpdatedReplicas == replicas &&
+		status.Replicas == replicas &&
+		status.AvailableReplicas == replicas
+}
+
+// verifyMesh runs the all-pairs check and fails unless every member can log
+// in to every other member. Logins from lockedOut members are expected to
+// fail and only logged.
+func (p *Provisioner) verifyMesh(ctx context.Context, spec ClusterSpec, lockedOut map[string]bool) error {
+	report, err := p.meshChecker.CheckMesh(ctx, spec.Namespace, spec.NamePrefix)
+	if err != nil {
+		return err
+	}
+	if report.Complete() {
+		return nil
+	}
+	if len(report.Members) == 0 {
+		return fmt.Errorf("no member of %q was checked", spec.NamePrefix)
+	}
+	var failed []string
+	for _, source := range report.Members {
+		for _, target := range report.Members {
+			result := report.Results[source][target]
+			if source == target || result.OK {
+				continue
+			}
+			if lockedOut[source] {
+				glog.Infof("revoked member %s cannot log in to %s yet: %s", source, target, result.Error)
+				continue
+			}
+			failed = append(failed, fmt.Sprintf("%s -> %s: %s", source, target, result.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d logins failed:\n%s", len(failed), strings.Join(failed, "\n"))
+}
+
+// KeysRotatedAt returns when the oldest member key was created or last
+// rotated.
+func (p *Provisioner) KeysRotatedAt(ctx context.Context, spec ClusterSpec) (time.Time, error) {
+	client := p.clients.GetControllerClient()
+	var oldest time.Time
+	for _, name := range memberNames(spec) {
+		secret := &coreV1.Secret{}
+		err := client.Get(ctx, types.NamespacedName{Namespace: spec.Namespace, Name: name}, secret)
+		if err != nil {
+			return time.Time{}, &APIError{Verb: "get", Kind: "Secret", Name: name, Err: err}
+		}
+		rotatedAt := secret.CreationTimestamp.Time
+		if value, ok := secret.Annotations[keysRotatedAtAnnotation]; ok {
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				rotatedAt = t
+			}
+		}
+		if oldest.IsZero() || rotatedAt.Before(oldest) {
+			oldest = rotatedAt
+		}
+	}
+	return oldest, nil
+}
+
+// RotateKeysOnSchedule rotates the member keys whenever the oldest of them
+// is older than spec.Keys.RotationInterval, until ctx is done. A failed
+// rotation is logged and tried again an hour later.
+func (p *Provisioner) RotateKeysOnSchedule(
+	ctx context.Context,
+	spec ClusterSpec,
+	options RotateOptions) error {
+	if spec.Keys.RotationInterval == nil {
+		return nil
+	}
+	interval := spec.Keys.RotationInterval.Duration
+	for {
+		next := rotateRetryInterval
+		rotatedAt, err := p.KeysRotatedAt(ctx, spec)
+		switch {
+		case err != nil:
+			glog.Errorf("failed to read the key age of %q: %v", spec.NamePrefix, err)
+		case time.Since(rotatedAt) < interval:
+			next = time.Until(rotatedAt.Add(interval))
+		default:
+			if err := p.RotateKeys(ctx, spec, options); err != nil {
+				glog.Errorf("failed to rotate the keys of %q: %v", spec.NamePrefix, err)
+			} else {
+				next = interval
+			}
+		}
+		glog.Infof("next key rotation check of %q in %v", spec.NamePrefix, next.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(next):
+		}
+	}
+}
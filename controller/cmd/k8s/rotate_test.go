@@ -0,0 +1,185 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRotateSteps(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	old := &sshKeys{
+		authorizedHosts: []byte("old-0\nshared\n"),
+		allPrivateKeys:  [][]byte{[]byte("old-0-private"), []byte("shared-private")},
+		allPublicKeys:   [][]byte{[]byte("old-0\n"), []byte("shared\n")},
+	}
+	fresh := &sshKeys{
+		authorizedHosts: []byte("new-0\nshared\n"),
+		allPrivateKeys:  [][]byte{[]byte("new-0-private"), []byte("shared-private")},
+		allPublicKeys:   [][]byte{[]byte("new-0\n"), []byte("shared\n")},
+	}
+
+	steps := rotateSteps(old, fresh, []byte("bastion\n"))
+	g.Expect(steps).To(gomega.HaveLen(3))
+	g.Expect(steps[0].stage).To(gomega.Equal(RotateStageTrust))
+	g.Expect(steps[0].privateKeys).To(gomega.Equal(old.allPrivateKeys))
+	g.Expect(string(steps[0].authorized)).To(gomega.Equal("old-0\nshared\nnew-0\nbastion\n"))
+	g.Expect(steps[1].stage).To(gomega.Equal(RotateStageSwitch))
+	g.Expect(steps[1].privateKeys).To(gomega.Equal(fresh.allPrivateKeys))
+	g.Expect(steps[1].authorized).To(gomega.Equal(steps[0].authorized))
+	g.Expect(steps[2].stage).To(gomega.Equal(RotateStagePrune))
+	g.Expect(string(steps[2].authorized)).To(gomega.Equal("new-0\nshared\nbastion\n"))
+}
+
+// markRolledOut sets the status of the member Deployments as if every pod
+// ran their current template.
+func markRolledOut(g *gomega.WithT, client ctrl.Client, spec ClusterSpec) {
+	ctx := context.Background()
+	for _, name := range memberNames(spec) {
+		deploy := &appsV1.Deployment{}
+		g.Expect(client.Get(ctx, types.NamespacedName{Namespace: spec.Namespace, Name: name}, deploy)).To(gomega.Succeed())
+		deploy.Status = appsV1.DeploymentStatus{
+			ObservedGeneration: deploy.Generation,
+			Replicas:           1,
+			UpdatedReplicas:    1,
+			AvailableReplicas:  1,
+		}
+		g.Expect(client.Update(ctx, deploy)).To(gomega.Succeed())
+	}
+}
+
+func TestRollKeys(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 2, Probe: DefaultProbeSpec()}
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	markRolledOut(g, client, spec)
+
+	step := rotateStep{
+		stage:       RotateStageSwitch,
+		privateKeys: [][]byte{[]byte("private-0"), []byte("private-1")},
+		publicKeys:  [][]byte{[]byte("public-0\n"), []byte("public-1\n")},
+		authorized:  []byte("public-0\npublic-1\n"),
+	}
+	before := time.Now().Add(-time.Second)
+	g.Expect(provisioner.rollKeys(ctx, spec, step, RotateOptions{Parallel: 2, Timeout: time.Minute})).To(gomega.Succeed())
+
+	secret := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-1"}, secret)).To(gomega.Succeed())
+	g.Expect(secret.Data["id_rsa"]).To(gomega.Equal([]byte("private-1")))
+	g.Expect(secret.Data["authorized_keys"]).To(gomega.Equal(step.authorized))
+	deploy := &appsV1.Deployment{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-1"}, deploy)).To(gomega.Succeed())
+	g.Expect(deploy.Spec.Template.Annotations).To(gomega.HaveKeyWithValue(keysVersionAnnotation, keysVersion(secret.Data)))
+
+	rotatedAt, err := provisioner.KeysRotatedAt(ctx, spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(rotatedAt).To(gomega.BeTemporally(">", before))
+
+	// Resuming a deploy rewrites the Secrets but keeps when they rotated.
+	_, err = provisioner.Apply(ctx, spec, ApplyOptions{Resume: true})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-1"}, secret)).To(gomega.Succeed())
+	g.Expect(secret.Annotations).To(gomega.HaveKey(keysRotatedAtAnnotation))
+	g.Expect(provisioner.KeysRotatedAt(ctx, spec)).To(gomega.Equal(rotatedAt))
+}
+
+func TestRollKeysTimeout(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, _ := newFakeProvisioner()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	step := rotateStep{
+		stage:       RotateStageTrust,
+		privateKeys: [][]byte{[]byte("private-0")},
+		publicKeys:  [][]byte{[]byte("public-0\n")},
+		authorized:  []byte("public-0\n"),
+	}
+	err = provisioner.rollKeys(ctx, spec, step, RotateOptions{Timeout: 10 * time.Millisecond})
+	var notReady *NotReadyError
+	g.Expect(errors.As(err, &notReady)).To(gomega.BeTrue())
+	g.Expect(notReady.Diagnoses).To(gomega.HaveKeyWithValue("sample-0", gomega.ContainSubstring("no pod was created")))
+}
+
+// fakeMeshChecker logs in from every member to every other the way sshd
+// would decide: the target must trust the key of the source, which must not
+// be revoked.
+type fakeMeshChecker struct {
+	client ctrl.Client
+}
+
+func (c fakeMeshChecker) CheckMesh(ctx context.Context, namespace string, namePrefix string) (*MeshReport, error) {
+	spec := ClusterSpec{Namespace: namespace, NamePrefix: namePrefix}
+	revoked := &coreV1.ConfigMap{}
+	if err := c.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: revokedConfigMapName(spec)}, revoked); err != nil {
+		return nil, err
+	}
+	secrets := &coreV1.SecretList{}
+	if err := c.client.List(ctx, secrets, ctrl.InNamespace(namespace), ctrl.MatchingLabels{clusterLabel: namePrefix}); err != nil {
+		return nil, err
+	}
+	report := &MeshReport{Results: map[string]map[string]PairResult{}}
+	for _, source := range secrets.Items {
+		report.Members = append(report.Members, source.Name)
+		report.Results[source.Name] = map[string]PairResult{}
+		key := strings.TrimSpace(string(source.Data["id_rsa.pub"]))
+		for _, target := range secrets.Items {
+			trusted := strings.Contains(string(target.Data["authorized_keys"]), key)
+			refused := strings.Contains(revoked.Data[revokedKeysKey], key)
+			result := PairResult{Source: source.Name, Target: target.Name, OK: trusted && !refused}
+			if !result.OK {
+				result.Error = "Permission denied (publickey)."
+			}
+			report.Results[source.Name][target.Name] = result
+		}
+	}
+	return report, nil
+}
+
+func TestRotateKeysAfterRevoke(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	provisioner = NewProvisioner(provisioner.clients, WithMeshChecker(fakeMeshChecker{client}))
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 2, Probe: DefaultProbeSpec()}
+	_, err := provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	markRolledOut(g, client, spec)
+	g.Expect(provisioner.verifyMesh(ctx, spec, nil)).To(gomega.Succeed())
+
+	_, err = provisioner.Revoke(ctx, spec, RevokeOptions{Member: "sample-1"})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(provisioner.verifyMesh(ctx, spec, nil)).To(gomega.MatchError(gomega.ContainSubstring("sample-1 -> sample-0")))
+
+	// The trust stage tolerates the revoked member, the switch lets it back in.
+	g.Expect(provisioner.RotateKeys(ctx, spec, RotateOptions{Timeout: time.Minute})).To(gomega.Succeed())
+	g.Expect(provisioner.verifyMesh(ctx, spec, nil)).To(gomega.Succeed())
+
+	// An imported key that is revoked would stay locked out.
+	secret := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-0"}, secret)).To(gomega.Succeed())
+	imported := filepath.Join(t.TempDir(), "sample-0")
+	g.Expect(os.WriteFile(imported, secret.Data["id_rsa"], 0600)).To(gomega.Succeed())
+	spec.Keys.MemberKeys = map[string]string{"sample-0": imported}
+	_, err = provisioner.Revoke(ctx, spec, RevokeOptions{Member: "sample-0"})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	err = provisioner.RotateKeys(ctx, spec, RotateOptions{Timeout: time.Minute})
+	var keyErr *KeyError
+	g.Expect(errors.As(err, &keyErr)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring(`"sample-0"`))
+}
@@ -0,0 +1,473 @@
+package k8s
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// RetentionPolicy decides what happens to the member PVCs on teardown.
+type RetentionPolicy string
+
+const (
+	RetentionPolicyKeep   RetentionPolicy = "keep"
+	RetentionPolicyDelete RetentionPolicy = "delete"
+)
+
+// ClusterSpec describes the SSH cluster to deploy. In a spec file the
+// namespace and name prefix come from the metadata.
+type ClusterSpec struct {
+	Namespace  string `json:"-"`
+	NamePrefix string `json:"-"`
+	PodNum     int    `json:"podNum"`
+	// Image runs sshd. Empty means the default image.
+	Image         string            `json:"image,omitempty"`
+	Persistence   PersistenceSpec   `json:"persistence"`
+	NetworkPolicy NetworkPolicySpec `json:"networkPolicy"`
+	Probe         ProbeSpec         `json:"probe"`
+	Keys          KeysSpec          `json:"keys"`
+	// Users are the public keys of people who log in to every member, as
+	// the account the members log in to each other as. They can be changed
+	// with "users sync" while the cluster runs.
+	Users []UserKeySpec `json:"users,omitempty"`
+	// LoginUsers are accounts created on every member. With at least one
+	// of them root can no longer log in.
+	LoginUsers  []LoginUserSpec `json:"loginUsers,omitempty"`
+	PodSecurity PodSecuritySpec `json:"podSecurity"`
+	// TemplatesDir holds templates that replace the embedded ones of the
+	// same name. Empty means only the embedded templates are used.
+	TemplatesDir string `json:"templatesDir,omitempty"`
+}
+
+// DefaultClusterSpec returns the spec deployed when nothing is configured.
+// Fields missing from a spec file keep these values.
+func DefaultClusterSpec() ClusterSpec {
+	return ClusterSpec{
+		Namespace:  "default",
+		NamePrefix: "sample",
+		PodNum:     2,
+		Persistence: PersistenceSpec{
+			Size:            "10Gi",
+			RetentionPolicy: RetentionPolicyKeep,
+		},
+		NetworkPolicy: NetworkPolicySpec{Enabled: true},
+		Probe:         DefaultProbeSpec(),
+	}
+}
+
+func (s *ClusterSpec) image() string {
+	if s.Image == "" {
+		return image
+	}
+	return s.Image
+}
+
+// PersistenceSpec gives every member its own PVC mounted at its home
+// directory, /root unless PodSecurity.Home says otherwise.
+type PersistenceSpec struct {
+	Enabled          bool            `json:"enabled"`
+	Size             string          `json:"size,omitempty"`
+	StorageClassName string          `json:"storageClassName,omitempty"`
+	RetentionPolicy  RetentionPolicy `json:"retentionPolicy,omitempty"`
+}
+
+// NetworkPolicySpec restricts SSH ingress to the cluster members plus the
+// listed CIDRs and namespaces. Leave it disabled when the CNI does not enforce
+// NetworkPolicies.
+type NetworkPolicySpec struct {
+	Enabled           bool     `json:"enabled"`
+	AllowedCIDRs      []string `json:"allowedCIDRs,omitempty"`
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+}
+
+// KeysSpec imports keys instead of generating them. Imported member keys
+// are used as they are, members without one get a generated key.
+type KeysSpec struct {
+	// MemberKeysDir holds private keys named after the members, e.g.
+	// sample-0.
+	MemberKeysDir string `json:"memberKeysDir,omitempty"`
+	// MemberKeys maps member names to private key files. They win over
+	// MemberKeysDir.
+	MemberKeys map[string]string `json:"memberKeys,omitempty"`
+	// TrustedKeys are authorized_keys files, or directories of *.pub files,
+	// whose keys every member accepts on top of the member keys.
+	TrustedKeys []string `json:"trustedKeys,omitempty"`
+	// RotationInterval is how old the member keys may get before the
+	// controller rotates them, e.g. 720h. Unset means never.
+	RotationInterval *metaV1.Duration `json:"rotationInterval,omitempty"`
+}
+
+// minRotationInterval leaves a rotation, which restarts every member three
+// times, time to finish before the next one is due.
+const minRotationInterval = time.Hour
+
+func (s *KeysSpec) validate(path *field.Path, members []string) field.ErrorList {
+	errs := field.ErrorList{}
+	names := map[string]bool{}
+	for _, name := range members {
+		names[name] = true
+	}
+	keyNames := make([]string, 0, len(s.MemberKeys))
+	for name := range s.MemberKeys {
+		keyNames = append(keyNames, name)
+	}
+	sort.Strings(keyNames)
+	for _, name := range keyNames {
+		file := s.MemberKeys[name]
+		if !names[name] {
+			errs = append(errs, field.Invalid(path.Child("memberKeys").Key(name), name, "is not a member of the cluster"))
+		}
+		if file == "" {
+			errs = append(errs, field.Required(path.Child("memberKeys").Key(name), ""))
+		}
+	}
+	for i, file := range s.TrustedKeys {
+		if file == "" {
+			errs = append(errs, field.Required(path.Child("trustedKeys").Index(i), ""))
+		}
+	}
+	if s.RotationInterval != nil && s.RotationInterval.Duration < minRotationInterval {
+		errs = append(errs, field.Invalid(path.Child("rotationInterval"), s.RotationInterval.Duration.String(),
+			fmt.Sprintf("must be at least %v", minRotationInterval)))
+	}
+	return errs
+}
+
+// UserKeySpec names the public keys of one user. Exactly one source is set:
+// authorized_keys lines, a file, a URL serving one key per line like
+// https://github.com/<user>.keys, or a key of a ConfigMap in the cluster
+// namespace. The options are added to every key of the user.
+type UserKeySpec struct {
+	Name         string        `json:"name"`
+	Key          string        `json:"key,omitempty"`
+	File         string        `json:"file,omitempty"`
+	URL          string        `json:"url,omitempty"`
+	ConfigMapRef *ConfigMapKey `json:"configMapRef,omitempty"`
+	// From limits the keys to these host patterns, see from= in sshd(8).
+	From []string `json:"from,omitempty"`
+	// Command is forced whatever the user asks to run.
+	Command string `json:"command,omitempty"`
+	// ExpiryTime is when the keys stop working, as YYYYMMDD[HHMM[SS]] in
+	// local time of the members or with a Z suffix in UTC.
+	ExpiryTime string `json:"expiryTime,omitempty"`
+}
+
+// ConfigMapKey selects a key of a ConfigMap.
+type ConfigMapKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// expiryTime matches the time formats sshd accepts in expiry-time=.
+var expiryTime = regexp.MustCompile(`^\d{8}(\d{4}(\d{2})?)?Z?$`)
+
+func (s *UserKeySpec) validate(path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if s.Name == "" {
+		errs = append(errs, field.Required(path.Child("name"), ""))
+	}
+	sources := []string{}
+	if s.Key != "" {
+		sources = append(sources, "key")
+	}
+	if s.File != "" {
+		sources = append(sources, "file")
+	}
+	if s.URL != "" {
+		sources = append(sources, "url")
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, field.Invalid(path.Child("url"), s.URL, "must be an http or https URL"))
+		}
+	}
+	if s.ConfigMapRef != nil {
+		sources = append(sources, "configMapRef")
+		refPath := path.Child("configMapRef")
+		for _, msg := range validation.IsDNS1123Subdomain(s.ConfigMapRef.Name) {
+			errs = append(errs, field.Invalid(refPath.Child("name"), s.ConfigMapRef.Name, msg))
+		}
+		for _, msg := range validation.IsConfigMapKey(s.ConfigMapRef.Key) {
+			errs = append(errs, field.Invalid(refPath.Child("key"), s.ConfigMapRef.Key, msg))
+		}
+	}
+	switch len(sources) {
+	case 0:
+		errs = append(errs, field.Required(path, "one of key, file, url or configMapRef"))
+	case 1:
+	default:
+		errs = append(errs, field.Forbidden(path, "only one of "+strings.Join(sources, ", ")+" may be set"))
+	}
+	for i, from := range s.From {
+		if from == "" || strings.ContainsAny(from, "\" \t\n,") {
+			errs = append(errs, field.Invalid(path.Child("from").Index(i), from, "must be a single host pattern"))
+		}
+	}
+	if strings.ContainsAny(s.Command, "\n") {
+		errs = append(errs, field.Invalid(path.Child("command"), s.Command, "must be a single line"))
+	}
+	if s.ExpiryTime != "" && !expiryTime.MatchString(s.ExpiryTime) {
+		errs = append(errs, field.Invalid(path.Child("expiryTime"), s.ExpiryTime, "must be YYYYMMDD[HHMM[SS]][Z]"))
+	}
+	return errs
+}
+
+// LoginUserSpec is an account with its own home directory and ~/.ssh, which
+// only trusts AuthorizedKeys. The first login user also trusts the member
+// keys and spec.Users, so the cluster members can still reach each other.
+type LoginUserSpec struct {
+	Name string `json:"name"`
+	// UID and GID are allocated by useradd when zero.
+	UID int64 `json:"uid,omitempty"`
+	GID int64 `json:"gid,omitempty"`
+	// Shell defaults to /bin/bash.
+	Shell          string   `json:"shell,omitempty"`
+	AuthorizedKeys []string `json:"authorizedKeys,omitempty"`
+	// Sudo lets the user run any command as root without a password.
+	Sudo bool `json:"sudo,omitempty"`
+}
+
+// loginName matches the names useradd accepts by default.
+var loginName = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+func (s *LoginUserSpec) validate(path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	switch {
+	case s.Name == "root":
+		errs = append(errs, field.Invalid(path.Child("name"), s.Name, "root is not a login user"))
+	case !loginName.MatchString(s.Name):
+		errs = append(errs, field.Invalid(path.Child("name"), s.Name, "must match "+loginName.String()))
+	}
+	if s.UID < 0 {
+		errs = append(errs, field.Invalid(path.Child("uid"), s.UID, "must not be negative"))
+	}
+	if s.GID < 0 {
+		errs = append(errs, field.Invalid(path.Child("gid"), s.GID, "must not be negative"))
+	}
+	if s.Shell != "" && !strings.HasPrefix(s.Shell, "/") {
+		errs = append(errs, field.Invalid(path.Child("shell"), s.Shell, "must be an absolute path"))
+	}
+	for i, key := range s.AuthorizedKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil || strings.Contains(strings.TrimSpace(key), "\n") {
+			errs = append(errs, field.Invalid(path.Child("authorizedKeys").Index(i), key, "must be a single authorized_keys line"))
+		}
+	}
+	return errs
+}
+
+// PodSecuritySpec makes the members pass the restricted Pod Security
+// Standard: sshd runs as RunAsUser on a high port, without capabilities or
+// privilege escalation and with the RuntimeDefault seccomp profile. Only
+// RunAsUser can log in then, so there are no LoginUsers.
+type PodSecuritySpec struct {
+	Restricted bool `json:"restricted"`
+	// RunAsUser must have an account in the image, with a group of the same
+	// ID and Home as its home directory. Defaults to the kssh user of the
+	// default image.
+	RunAsUser int64  `json:"runAsUser,omitempty"`
+	Home      string `json:"home,omitempty"`
+	// Port sshd listens on, defaults to restrictedPort.
+	Port int `json:"port,omitempty"`
+}
+
+const (
+	restrictedUser = 1000
+	restrictedHome = "/home/kssh"
+	restrictedPort = 2222
+)
+
+func (s *PodSecuritySpec) validate(path *field.Path, loginUsers []LoginUserSpec) field.ErrorList {
+	errs := field.ErrorList{}
+	if !s.Restricted {
+		return errs
+	}
+	if s.RunAsUser < 0 {
+		errs = append(errs, field.Invalid(path.Child("runAsUser"), s.RunAsUser, "must be a non-root UID"))
+	}
+	if s.Home != "" && !strings.HasPrefix(s.Home, "/") {
+		errs = append(errs, field.Invalid(path.Child("home"), s.Home, "must be an absolute path"))
+	}
+	if s.Port != 0 && (s.Port <= 1024 || s.Port > 65535) {
+		errs = append(errs, field.Invalid(path.Child("port"), s.Port, "must be between 1025 and 65535"))
+	}
+	if len(loginUsers) != 0 {
+		errs = append(errs, field.Forbidden(field.NewPath("loginUsers"), "need root, which podSecurity.restricted rules out"))
+	}
+	return errs
+}
+
+func (s *PodSecuritySpec) runAsUser() int64 {
+	if s.RunAsUser == 0 {
+		return restrictedUser
+	}
+	return s.RunAsUser
+}
+
+func (s *PodSecuritySpec) home() string {
+	if !s.Restricted {
+		return "/root"
+	}
+	if s.Home == "" {
+		return restrictedHome
+	}
+	return s.Home
+}
+
+// port is the port sshd listens on.
+func (s *PodSecuritySpec) port() int {
+	switch {
+	case !s.Restricted:
+		return appPort
+	case s.Port == 0:
+		return restrictedPort
+	}
+	return s.Port
+}
+
+// loginUser is the account the members log in to each other as when it is
+// not the one sshd runs as.
+func (s *ClusterSpec) loginUser() string {
+	if len(s.LoginUsers) == 0 {
+		return ""
+	}
+	return s.LoginUsers[0].Name
+}
+
+// ProbeSpec tunes the startup, readiness and liveness probes of sshd. All
+// three probes read the SSH protocol banner from the configured port.
+type ProbeSpec struct {
+	PeriodSeconds             int `json:"periodSeconds"`
+	TimeoutSeconds            int `json:"timeoutSeconds"`
+	StartupFailureThreshold   int `json:"startupFailureThreshold"`
+	ReadinessFailureThreshold int `json:"readinessFailureThreshold"`
+	LivenessFailureThreshold  int `json:"livenessFailureThreshold"`
+}
+
+// DefaultProbeSpec gives sshd five minutes to start and restarts it after
+// thirty seconds without a banner.
+func DefaultProbeSpec() ProbeSpec {
+	return ProbeSpec{
+		PeriodSeconds:             10,
+		TimeoutSeconds:            5,
+		StartupFailureThreshold:   30,
+		ReadinessFailureThreshold: 1,
+		LivenessFailureThreshold:  3,
+	}
+}
+
+func (s *ProbeSpec) validate(path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"periodSeconds", s.PeriodSeconds},
+		{"timeoutSeconds", s.TimeoutSeconds},
+		{"startupFailureThreshold", s.StartupFailureThreshold},
+		{"readinessFailureThreshold", s.ReadinessFailureThreshold},
+		{"livenessFailureThreshold", s.LivenessFailureThreshold},
+	} {
+		if f.value < 1 {
+			errs = append(errs, field.Invalid(path.Child(f.name), f.value, "must be positive"))
+		}
+	}
+	return errs
+}
+
+// validateNames checks the namespace and the names derived from NamePrefix.
+// Members name their Services, so the last member, the longest name, must be
+// a DNS-1035 label.
+func (s *ClusterSpec) validateNames() field.ErrorList {
+	errs := field.ErrorList{}
+	for _, msg := range validation.IsDNS1123Label(s.Namespace) {
+		errs = append(errs, field.Invalid(field.NewPath("metadata", "namespace"), s.Namespace, msg))
+	}
+	if s.PodNum < 1 {
+		return errs
+	}
+	last := fmt.Sprintf("%s-%d", s.NamePrefix, s.PodNum-1)
+	for _, msg := range validation.IsDNS1035Label(last) {
+		errs = append(errs, field.Invalid(field.NewPath("metadata", "name"), s.NamePrefix,
+			fmt.Sprintf("member name %q: %s", last, msg)))
+	}
+	return errs
+}
+
+// Validate checks the spec and returns a *ValidationError listing every
+// problem.
+func (s *ClusterSpec) Validate() error {
+	errs := field.ErrorList{}
+	if s.PodNum < 1 {
+		errs = append(errs, field.Invalid(field.NewPath("podNum"), s.PodNum, "must be positive"))
+	}
+	errs = append(errs, s.validateNames()...)
+	errs = append(errs, s.Probe.validate(field.NewPath("probe"))...)
+	errs = append(errs, s.Keys.validate(field.NewPath("keys"), memberNames(*s))...)
+	users := map[string]bool{}
+	for i := range s.Users {
+		user := &s.Users[i]
+		path := field.NewPath("users").Index(i)
+		errs = append(errs, user.validate(path)...)
+		if users[user.Name] {
+			errs = append(errs, field.Duplicate(path.Child("name"), user.Name))
+		}
+		users[user.Name] = true
+	}
+	errs = append(errs, s.PodSecurity.validate(field.NewPath("podSecurity"), s.LoginUsers)...)
+	loginUsers := map[string]bool{}
+	for i := range s.LoginUsers {
+		user := &s.LoginUsers[i]
+		path := field.NewPath("loginUsers").Index(i)
+		errs = append(errs, user.validate(path)...)
+		if loginUsers[user.Name] {
+			errs = append(errs, field.Duplicate(path.Child("name"), user.Name))
+		}
+		loginUsers[user.Name] = true
+	}
+
+	policyPath := field.NewPath("networkPolicy")
+	for i, cidr := range s.NetworkPolicy.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, field.Invalid(policyPath.Child("allowedCIDRs").Index(i), cidr, err.Error()))
+		}
+	}
+	for i, ns := range s.NetworkPolicy.AllowedNamespaces {
+		for _, msg := range validation.IsDNS1123Label(ns) {
+			errs = append(errs, field.Invalid(policyPath.Child("allowedNamespaces").Index(i), ns, msg))
+		}
+	}
+
+	// The retention policy also applies to the PVCs of an earlier deploy, so
+	// it is checked whether or not persistence is enabled. Without
+	// persistence it may be left empty, which keeps them.
+	persistencePath := field.NewPath("persistence")
+	if s.Persistence.Enabled {
+		if _, err := resource.ParseQuantity(s.Persistence.Size); err != nil {
+			errs = append(errs, field.Invalid(persistencePath.Child("size"), s.Persistence.Size, err.Error()))
+		}
+	}
+	switch s.Persistence.RetentionPolicy {
+	case RetentionPolicyKeep, RetentionPolicyDelete:
+	case "":
+		if s.Persistence.Enabled {
+			errs = append(errs, field.Required(persistencePath.Child("retentionPolicy"), ""))
+		}
+	default:
+		errs = append(errs, field.NotSupported(persistencePath.Child("retentionPolicy"),
+			s.Persistence.RetentionPolicy,
+			[]string{string(RetentionPolicyKeep), string(RetentionPolicyDelete)}))
+	}
+
+	if len(errs) != 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
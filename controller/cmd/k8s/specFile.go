@@ -0,0 +1,120 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/zicongmei/kubernetes-ssh/controller/cmd/k8s/yamlDecoder"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	sigsJson "sigs.k8s.io/json"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// SpecAPIVersion and SpecKind identify a cluster spec file.
+	SpecAPIVersion = "ssh.zicongmei.github.io/v1alpha1"
+	SpecKind       = "SSHCluster"
+)
+
+// clusterSpecFile is the versioned file format of a ClusterSpec:
+//
+//	apiVersion: ssh.zicongmei.github.io/v1alpha1
+//	kind: SSHCluster
+//	metadata:
+//	  name: sample
+//	  namespace: default
+//	spec:
+//	  podNum: 3
+type clusterSpecFile struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace,omitempty"`
+	} `json:"metadata"`
+	Spec ClusterSpec `json:"spec"`
+}
+
+// typeErrorPath extracts the field path from a json type error such as
+// "cannot unmarshal string into Go struct field clusterSpecFile.spec.podNum".
+var typeErrorPath = regexp.MustCompile(`Go struct field \w+\.(\S+) of type`)
+
+// ReadClusterSpecFile reads a spec file, see ParseClusterSpec.
+func ReadClusterSpecFile(path string) (ClusterSpec, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ClusterSpec{}, fmt.Errorf("failed to read spec file: %w", err)
+	}
+	return ParseClusterSpec(string(content))
+}
+
+// ParseClusterSpec decodes a spec file holding a single SSHCluster. Fields
+// that are not set keep their DefaultClusterSpec value. Unknown and mistyped
+// fields are reported as a *ValidationError with their paths, the values
+// themselves are checked by Validate.
+func ParseClusterSpec(content string) (ClusterSpec, error) {
+	objs, err := yamlDecoder.Decode(content)
+	if err != nil {
+		return ClusterSpec{}, err
+	}
+	if len(objs) != 1 {
+		return ClusterSpec{}, fmt.Errorf("spec file must hold exactly one %s, found %d documents", SpecKind, len(objs))
+	}
+	obj := objs[0]
+
+	errs := field.ErrorList{}
+	if obj.GetAPIVersion() != SpecAPIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), obj.GetAPIVersion(), []string{SpecAPIVersion}))
+	}
+	if obj.GetKind() != SpecKind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), obj.GetKind(), []string{SpecKind}))
+	}
+	if len(errs) != 0 {
+		return ClusterSpec{}, &ValidationError{Errors: errs}
+	}
+
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return ClusterSpec{}, err
+	}
+	defaults := DefaultClusterSpec()
+	file := clusterSpecFile{Spec: defaults}
+	strictErrs, err := sigsJson.UnmarshalStrict(data, &file)
+	for _, strictErr := range strictErrs {
+		// The strict errors read `unknown field "spec.x"`.
+		reason, path, _ := strings.Cut(strictErr.Error(), ` "`)
+		errs = append(errs, field.Forbidden(field.NewPath(strings.TrimSuffix(path, `"`)), reason))
+	}
+	if err != nil {
+		path := field.NewPath("spec")
+		if match := typeErrorPath.FindStringSubmatch(err.Error()); match != nil {
+			path = field.NewPath(match[1])
+		}
+		errs = append(errs, field.Invalid(path, nil, err.Error()))
+	}
+	if file.Metadata.Name == "" {
+		errs = append(errs, field.Required(field.NewPath("metadata", "name"), "the name prefix of the members"))
+	}
+	if len(errs) != 0 {
+		return ClusterSpec{}, &ValidationError{Errors: errs}
+	}
+
+	spec := file.Spec
+	spec.NamePrefix = file.Metadata.Name
+	spec.Namespace = file.Metadata.Namespace
+	if spec.Namespace == "" {
+		spec.Namespace = defaults.Namespace
+	}
+	return spec, nil
+}
+
+// MarshalClusterSpec writes spec in the format ParseClusterSpec reads.
+func MarshalClusterSpec(spec ClusterSpec) ([]byte, error) {
+	file := clusterSpecFile{APIVersion: SpecAPIVersion, Kind: SpecKind, Spec: spec}
+	file.Metadata.Name = spec.NamePrefix
+	file.Metadata.Namespace = spec.Namespace
+	return yaml.Marshal(file)
+}
@@ -0,0 +1,94 @@
+package k8s
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+)
+
+func TestParseClusterSpec(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec, err := ParseClusterSpec(`
+apiVersion: ssh.zicongmei.github.io/v1alpha1
+kind: SSHCluster
+metadata:
+  name: lab
+  namespace: ssh
+spec:
+  podNum: 4
+  image: example.com/sshd:1
+  persistence:
+    enabled: true
+    size: 5Gi
+  probe:
+    periodSeconds: 20
+  keys:
+    rotationInterval: 720h
+`)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(spec.Validate()).To(gomega.Succeed())
+	g.Expect(spec.NamePrefix).To(gomega.Equal("lab"))
+	g.Expect(spec.Namespace).To(gomega.Equal("ssh"))
+	g.Expect(spec.PodNum).To(gomega.Equal(4))
+	g.Expect(spec.image()).To(gomega.Equal("example.com/sshd:1"))
+	g.Expect(spec.Persistence.Size).To(gomega.Equal("5Gi"))
+	// Unset fields keep their defaults.
+	g.Expect(spec.Persistence.RetentionPolicy).To(gomega.Equal(RetentionPolicyKeep))
+	g.Expect(spec.NetworkPolicy.Enabled).To(gomega.BeTrue())
+	g.Expect(spec.Probe.PeriodSeconds).To(gomega.Equal(20))
+	g.Expect(spec.Probe.TimeoutSeconds).To(gomega.Equal(DefaultProbeSpec().TimeoutSeconds))
+	g.Expect(spec.Keys.RotationInterval.Duration).To(gomega.Equal(30 * 24 * time.Hour))
+
+	spec.Keys.RotationInterval.Duration = time.Minute
+	var validationErr *ValidationError
+	g.Expect(errors.As(spec.Validate(), &validationErr)).To(gomega.BeTrue())
+	g.Expect(fieldsOf(validationErr)).To(gomega.Equal([]string{"keys.rotationInterval"}))
+}
+
+func TestParseClusterSpecStrict(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	_, err := ParseClusterSpec(`
+apiVersion: ssh.zicongmei.github.io/v1alpha1
+kind: SSHCluster
+metadata:
+  namespace: ssh
+spec:
+  podnum: 4
+  persistence:
+    enable: true
+`)
+	var validationErr *ValidationError
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+	g.Expect(fieldsOf(validationErr)).To(gomega.ConsistOf("spec.podnum", "spec.persistence.enable", "metadata.name"))
+
+	_, err = ParseClusterSpec(`
+apiVersion: ssh.zicongmei.github.io/v1alpha1
+kind: SSHCluster
+metadata:
+  name: lab
+spec:
+  probe:
+    periodSeconds: ten
+`)
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+	g.Expect(fieldsOf(validationErr)).To(gomega.Equal([]string{"spec.probe.periodSeconds"}))
+
+	_, err = ParseClusterSpec(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: lab
+`)
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Errors).To(gomega.HaveLen(2))
+}
+
+func fieldsOf(err *ValidationError) []string {
+	fields := []string{}
+	for _, e := range err.Errors {
+		fields = append(fields, e.Field)
+	}
+	return fields
+}
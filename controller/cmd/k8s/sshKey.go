@@ -1,19 +1,32 @@
 package k8s
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/golang/glog"
 	"golang.org/x/crypto/ssh"
 )
 
-func generateSSHKey() ([]byte, []byte) {
+// hostKeyKey is the key of the host key in a member Secret, the public half
+// is under hostKeyKey + ".pub".
+const hostKeyKey = "ssh_host_key"
+
+func generateSSHKey() ([]byte, []byte, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, sshSize)
 	if err != nil {
-		glog.Fatalf("failed to generate private key: %v", err)
+		return nil, nil, &KeyError{Err: fmt.Errorf("failed to generate private key: %w", err)}
 	}
 
 	privateKeyBytes := pem.EncodeToMemory(&pem.Block{
@@ -24,8 +37,193 @@ func generateSSHKey() ([]byte, []byte) {
 
 	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
 	if err != nil {
-		glog.Fatalf("failed to generate public key: %v", err)
+		return nil, nil, &KeyError{Err: fmt.Errorf("failed to generate public key: %w", err)}
 	}
 	publicKeyBytes := ssh.MarshalAuthorizedKey(publicKey)
-	return privateKeyBytes, publicKeyBytes
+	return privateKeyBytes, publicKeyBytes, nil
+}
+
+// generateHostKey generates the key sshd of a member identifies itself with.
+// It is not the member key, which is handed out by "keys export". ECDSA keys
+// take no time to generate, unlike the RSA member keys.
+func generateHostKey() ([]byte, []byte, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, &KeyError{Err: fmt.Errorf("failed to generate host key: %w", err)}
+	}
+	der, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, &KeyError{Err: fmt.Errorf("failed to marshal host key: %w", err)}
+	}
+	privateKeyBytes := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, &KeyError{Err: fmt.Errorf("failed to generate host public key: %w", err)}
+	}
+	return privateKeyBytes, ssh.MarshalAuthorizedKey(publicKey), nil
+}
+
+// readSSHKey reads an unencrypted private key in any format ssh-keygen
+// writes and derives its public key.
+func readSSHKey(path string) ([]byte, []byte, error) {
+	privateKeyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, &KeyError{Err: fmt.Errorf("failed to read private key: %w", err)}
+	}
+	signer, err := ssh.ParsePrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, nil, &KeyError{Err: fmt.Errorf("failed to parse private key %s: %w", path, err)}
+	}
+	return privateKeyBytes, ssh.MarshalAuthorizedKey(signer.PublicKey()), nil
+}
+
+// memberKeyFiles returns the private key file spec.Keys imports for each
+// member index, members without one are left out. A missing
+// MemberKeysDir is an error, it would silently generate every key.
+func memberKeyFiles(spec ClusterSpec) (map[int]string, error) {
+	files := map[int]string{}
+	if dir := spec.Keys.MemberKeysDir; dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, &KeyError{Err: fmt.Errorf("failed to read member keys: %w", err)}
+		}
+		if !info.IsDir() {
+			return nil, &KeyError{Err: fmt.Errorf("member keys %s is not a directory", dir)}
+		}
+	}
+	for i, name := range memberNames(spec) {
+		if file, ok := spec.Keys.MemberKeys[name]; ok {
+			files[i] = file
+			continue
+		}
+		if spec.Keys.MemberKeysDir == "" {
+			continue
+		}
+		file := filepath.Join(spec.Keys.MemberKeysDir, name)
+		_, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, &KeyError{Err: fmt.Errorf("failed to read private key: %w", err)}
+		}
+		files[i] = file
+	}
+	return files, nil
+}
+
+// readTrustedKeys reads authorized_keys files, and the *.pub files of
+// directories, in the given order. Every key is checked, blank lines and
+// comments are dropped.
+func readTrustedKeys(paths []string) ([]byte, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, &KeyError{Err: fmt.Errorf("failed to read trusted keys: %w", err)}
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		pubs, err := filepath.Glob(filepath.Join(path, "*.pub"))
+		if err != nil {
+			return nil, &KeyError{Err: fmt.Errorf("failed to read trusted keys: %w", err)}
+		}
+		sort.Strings(pubs)
+		files = append(files, pubs...)
+	}
+	var trusted []byte
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, &KeyError{Err: fmt.Errorf("failed to read trusted keys: %w", err)}
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+				return nil, &KeyError{Err: fmt.Errorf("%s:%d: %w", file, i+1, err)}
+			}
+			trusted = append(trusted, line+"\n"...)
+		}
+	}
+	return trusted, nil
+}
+
+// knownHosts lists the host key of every member under the names it is
+// reachable by inside the cluster. Members whose Secret predates host keys
+// have none until the next deploy and are left out.
+func knownHosts(spec ClusterSpec, hostKeys [][]byte) ([]byte, error) {
+	var b bytes.Buffer
+	for i, name := range memberNames(spec) {
+		if len(hostKeys[i]) == 0 {
+			glog.Warningf("member %q has no host key yet, deploy again to give it one", name)
+			continue
+		}
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey(hostKeys[i])
+		if err != nil {
+			return nil, &KeyError{Err: fmt.Errorf("failed to parse host key of %q: %w", name, err)}
+		}
+		hosts := []string{name, name + "." + spec.Namespace, name + "." + spec.Namespace + ".svc"}
+		if port := spec.PodSecurity.port(); port != 22 {
+			for j, host := range hosts {
+				hosts[j] = fmt.Sprintf("[%s]:%d", host, port)
+			}
+		}
+		fmt.Fprintf(&b, "%s %s", strings.Join(hosts, ","), ssh.MarshalAuthorizedKey(publicKey))
+	}
+	return b.Bytes(), nil
+}
+
+// ExportKeys writes the key pair of every member, as <member> and
+// <member>.pub, and a known_hosts for all of them to dir. Every file is only
+// readable by its owner. It returns the paths written.
+func (p *Provisioner) ExportKeys(
+	ctx context.Context,
+	spec ClusterSpec,
+	dir string) ([]string, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	keys, err := p.loadSSHKeys(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := knownHosts(spec, keys.hostPublicKeys)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	var written []string
+	write := func(name string, content []byte) error {
+		path := filepath.Join(dir, name)
+		if err := writePrivateFile(path, content); err != nil {
+			return err
+		}
+		written = append(written, path)
+		return nil
+	}
+	for i, name := range memberNames(spec) {
+		if err := write(name, keys.allPrivateKeys[i]); err != nil {
+			return written, err
+		}
+		if err := write(name+".pub", keys.allPublicKeys[i]); err != nil {
+			return written, err
+		}
+	}
+	return written, write("known_hosts", hosts)
+}
+
+// writePrivateFile writes a file only its owner can read, also when it
+// existed with a wider mode.
+func writePrivateFile(path string, content []byte) error {
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
 }
@@ -0,0 +1,111 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/onsi/gomega"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestImportAndExportKeys(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	provisioner, client := newFakeProvisioner()
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		g.Expect(os.MkdirAll(filepath.Dir(path), 0700)).To(gomega.Succeed())
+		g.Expect(os.WriteFile(path, content, 0600)).To(gomega.Succeed())
+		return path
+	}
+	privateKey0, publicKey0, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	privateKey1, _, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	_, laptopKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	_, bastionKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	write("members/sample-0", privateKey0)
+	write("trusted/laptop.pub", laptopKey)
+	write("trusted/README", []byte("not a key"))
+	spec := ClusterSpec{
+		Namespace:  "ns",
+		NamePrefix: "sample",
+		PodNum:     3,
+		Probe:      DefaultProbeSpec(),
+		Keys: KeysSpec{
+			MemberKeysDir: filepath.Join(dir, "members"),
+			MemberKeys:    map[string]string{"sample-1": write("one", privateKey1)},
+			TrustedKeys: []string{
+				filepath.Join(dir, "trusted"),
+				write("authorized_keys", append([]byte("# bastion\n\n"), bastionKey...)),
+			},
+		},
+	}
+
+	_, err = provisioner.Apply(ctx, spec, ApplyOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	secret := &coreV1.Secret{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "sample-0"}, secret)).To(gomega.Succeed())
+	g.Expect(secret.Data["id_rsa"]).To(gomega.Equal(privateKey0))
+	g.Expect(secret.Data["id_rsa.pub"]).To(gomega.Equal(publicKey0))
+	hostKey0 := secret.Data[hostKeyKey+".pub"]
+	g.Expect(hostKey0).NotTo(gomega.BeEmpty())
+	g.Expect(hostKey0).NotTo(gomega.Equal(publicKey0))
+	authorizedKeys := strings.Split(strings.TrimSpace(string(secret.Data["authorized_keys"])), "\n")
+	g.Expect(authorizedKeys).To(gomega.HaveLen(5))
+	g.Expect(authorizedKeys[3:]).To(gomega.Equal([]string{
+		strings.TrimSpace(string(laptopKey)), strings.TrimSpace(string(bastionKey)),
+	}))
+
+	out := filepath.Join(dir, "export")
+	written, err := provisioner.ExportKeys(ctx, spec, out)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(written).To(gomega.HaveLen(7))
+	for _, path := range written {
+		info, err := os.Stat(path)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(info.Mode().Perm()).To(gomega.Equal(os.FileMode(0600)), path)
+	}
+	g.Expect(os.ReadFile(filepath.Join(out, "sample-1"))).To(gomega.Equal(privateKey1))
+	hosts, err := os.ReadFile(filepath.Join(out, "known_hosts"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(string(hosts)).To(gomega.HavePrefix("sample-0,sample-0.ns,sample-0.ns.svc " + string(hostKey0)))
+	g.Expect(string(hosts)).NotTo(gomega.ContainSubstring(strings.TrimSpace(string(publicKey0))))
+	g.Expect(strings.Count(string(hosts), "\n")).To(gomega.Equal(3))
+}
+
+func TestImportKeysErrors(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir := t.TempDir()
+	spec := DefaultClusterSpec()
+	spec.Keys.MemberKeys = map[string]string{"sample-5": "key"}
+	var validationErr *ValidationError
+	g.Expect(errors.As(spec.Validate(), &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Errors[0].Field).To(gomega.Equal("keys.memberKeys[sample-5]"))
+
+	path := filepath.Join(dir, "authorized_keys")
+	g.Expect(os.WriteFile(path, []byte("ssh-rsa not-base64\n"), 0600)).To(gomega.Succeed())
+	_, err := readTrustedKeys([]string{path})
+	var keyErr *KeyError
+	g.Expect(errors.As(err, &keyErr)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring(path + ":1"))
+
+	_, _, err = readSSHKey(path)
+	g.Expect(errors.As(err, &keyErr)).To(gomega.BeTrue())
+
+	spec.Keys.MemberKeys = nil
+	spec.Keys.MemberKeysDir = filepath.Join(dir, "missing")
+	_, err = memberKeyFiles(spec)
+	g.Expect(errors.As(err, &keyErr)).To(gomega.BeTrue())
+	spec.Keys.MemberKeysDir = path
+	_, err = memberKeyFiles(spec)
+	g.Expect(errors.As(err, &keyErr)).To(gomega.BeTrue())
+}
@@ -0,0 +1,405 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	clusterLabel = "cluster"
+	memberLabel  = "run"
+
+	// statusDebounce coalesces bursts of informer events into one report.
+	statusDebounce = 500 * time.Millisecond
+)
+
+// ClusterStatus is the health of one SSH cluster.
+type ClusterStatus struct {
+	Namespace string         `json:"namespace"`
+	Name      string         `json:"name"`
+	Members   []MemberStatus `json:"members"`
+	// RevokedKeys are the keys "keys revoke" recorded.
+	RevokedKeys []RevokedKey `json:"revokedKeys,omitempty"`
+}
+
+// MemberStatus is the health of one member of an SSH cluster.
+type MemberStatus struct {
+	Name          string   `json:"name"`
+	ReadyReplicas int32    `json:"readyReplicas"`
+	Replicas      int32    `json:"replicas"`
+	Pod           string   `json:"pod,omitempty"`
+	Phase         string   `json:"phase,omitempty"`
+	Ready         bool     `json:"ready"`
+	Node          string   `json:"node,omitempty"`
+	PodIP         string   `json:"podIP,omitempty"`
+	Restarts      int32    `json:"restarts"`
+	Endpoints     []string `json:"endpoints,omitempty"`
+	Fingerprint   string   `json:"fingerprint,omitempty"`
+}
+
+// Healthy reports whether every member of the cluster is ready.
+func (s *ClusterStatus) Healthy() bool {
+	for _, member := range s.Members {
+		if !member.Ready {
+			return false
+		}
+	}
+	return len(s.Members) != 0
+}
+
+// statusSelector selects the objects of every cluster in the namespace, or
+// of one cluster when a prefix is given.
+func statusSelector(namePrefix string) string {
+	if namePrefix == "" {
+		return clusterLabel
+	}
+	return clusterLabel + "=" + namePrefix
+}
+
+// Status discovers the clusters in a namespace, or the one cluster with the
+// given prefix, and reports the health of their members.
+func (p *Provisioner) Status(
+	ctx context.Context,
+	namespace string,
+	namePrefix string) ([]ClusterStatus, error) {
+	cs := p.clients.GetClientSet()
+	options := metaV1.ListOptions{LabelSelector: statusSelector(namePrefix)}
+
+	deploys, err := cs.AppsV1().Deployments(namespace).List(ctx, options)
+	if err != nil {
+		return nil, &APIError{Verb: "list", Kind: "Deployment", Err: err}
+	}
+	pods, err := cs.CoreV1().Pods(namespace).List(ctx, options)
+	if err != nil {
+		return nil, &APIError{Verb: "list", Kind: "Pod", Err: err}
+	}
+	endpoints, err := cs.CoreV1().Endpoints(namespace).List(ctx, options)
+	if err != nil {
+		return nil, &APIError{Verb: "list", Kind: "Endpoints", Err: err}
+	}
+	secrets, err := cs.CoreV1().Secrets(namespace).List(ctx, options)
+	if err != nil {
+		return nil, &APIError{Verb: "list", Kind: "Secret", Err: err}
+	}
+	configMaps, err := cs.CoreV1().ConfigMaps(namespace).List(ctx, options)
+	if err != nil {
+		return nil, &APIError{Verb: "list", Kind: "ConfigMap", Err: err}
+	}
+	return buildClusterStatuses(
+		namespace,
+		toPointers(deploys.Items),
+		toPointers(pods.Items),
+		toPointers(endpoints.Items),
+		toPointers(secrets.Items),
+		toPointers(configMaps.Items)), nil
+}
+
+// WatchStatus keeps the cluster statuses up to date with informers and calls
+// report every time they change, until the context is done.
+func (p *Provisioner) WatchStatus(
+	ctx context.Context,
+	namespace string,
+	namePrefix string,
+	report func([]ClusterStatus)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		p.clients.GetClientSet(),
+		0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metaV1.ListOptions) {
+			options.LabelSelector = statusSelector(namePrefix)
+		}))
+	deployLister := factory.Apps().V1().Deployments().Lister()
+	podLister := factory.Core().V1().Pods().Lister()
+	endpointsLister := factory.Core().V1().Endpoints().Lister()
+	secretLister := factory.Core().V1().Secrets().Lister()
+	configMapLister := factory.Core().V1().ConfigMaps().Lister()
+
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		factory.Apps().V1().Deployments().Informer(),
+		factory.Core().V1().Pods().Informer(),
+		factory.Core().V1().Endpoints().Informer(),
+		factory.Core().V1().Secrets().Informer(),
+		factory.Core().V1().ConfigMaps().Informer(),
+	} {
+		informer.AddEventHandler(handler)
+	}
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	// The caches only fail to sync once the context is done.
+	for _, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil
+		}
+	}
+
+	var last []ClusterStatus
+	notify()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(statusDebounce):
+		}
+
+		deploys, err := deployLister.List(labels.Everything())
+		if err != nil {
+			return fmt.Errorf("failed to list deployments from the cache: %w", err)
+		}
+		pods, err := podLister.List(labels.Everything())
+		if err != nil {
+			return fmt.Errorf("failed to list pods from the cache: %w", err)
+		}
+		endpoints, err := endpointsLister.List(labels.Everything())
+		if err != nil {
+			return fmt.Errorf("failed to list endpoints from the cache: %w", err)
+		}
+		secrets, err := secretLister.List(labels.Everything())
+		if err != nil {
+			return fmt.Errorf("failed to list secrets from the cache: %w", err)
+		}
+		configMaps, err := configMapLister.List(labels.Everything())
+		if err != nil {
+			return fmt.Errorf("failed to list configmaps from the cache: %w", err)
+		}
+		statuses := buildClusterStatuses(namespace, deploys, pods, endpoints, secrets, configMaps)
+		if last != nil && reflect.DeepEqual(statuses, last) {
+			continue
+		}
+		last = statuses
+		report(statuses)
+	}
+}
+
+func toPointers[T any](items []T) []*T {
+	pointers := make([]*T, 0, len(items))
+	for i := range items {
+		pointers = append(pointers, &items[i])
+	}
+	return pointers
+}
+
+// buildClusterStatuses groups the members by cluster. Every Deployment is a
+// member; the pod, endpoints and secret of a member share its name. The
+// revoked ConfigMap of a cluster lists its revoked keys.
+func buildClusterStatuses(
+	namespace string,
+	deploys []*appsV1.Deployment,
+	pods []*coreV1.Pod,
+	endpoints []*coreV1.Endpoints,
+	secrets []*coreV1.Secret,
+	configMaps []*coreV1.ConfigMap) []ClusterStatus {
+	podsOfMember := map[string][]*coreV1.Pod{}
+	for _, pod := range pods {
+		member := pod.Labels[memberLabel]
+		podsOfMember[member] = append(podsOfMember[member], pod)
+	}
+	endpointsByName := map[string]*coreV1.Endpoints{}
+	for _, e := range endpoints {
+		endpointsByName[e.Name] = e
+	}
+	secretsByName := map[string]*coreV1.Secret{}
+	for _, secret := range secrets {
+		secretsByName[secret.Name] = secret
+	}
+
+	clusters := map[string]*ClusterStatus{}
+	for _, deploy := range deploys {
+		name := deploy.Labels[clusterLabel]
+		cluster, ok := clusters[name]
+		if !ok {
+			cluster = &ClusterStatus{Namespace: namespace, Name: name}
+			clusters[name] = cluster
+		}
+		member := MemberStatus{
+			Name:          deploy.Name,
+			ReadyReplicas: deploy.Status.ReadyReplicas,
+			Replicas:      deploy.Status.Replicas,
+			Endpoints:     endpointAddresses(endpointsByName[deploy.Name]),
+			Fingerprint:   secretFingerprint(secretsByName[deploy.Name]),
+		}
+		if pod := newestPod(podsOfMember[deploy.Name]); pod != nil {
+			member.Pod = pod.Name
+			member.Phase = string(pod.Status.Phase)
+			member.Ready = isPodReady(pod)
+			member.Node = pod.Spec.NodeName
+			member.PodIP = pod.Status.PodIP
+			for _, status := range pod.Status.ContainerStatuses {
+				member.Restarts += status.RestartCount
+			}
+		}
+		cluster.Members = append(cluster.Members, member)
+	}
+
+	for _, configMap := range configMaps {
+		cluster, ok := clusters[configMap.Labels[clusterLabel]]
+		if !ok || !isRevokedConfigMap(configMap) {
+			continue
+		}
+		for _, key := range parseRevokedKeys([]byte(configMap.Data[revokedKeysKey])) {
+			cluster.RevokedKeys = append(cluster.RevokedKeys, key.RevokedKey)
+		}
+	}
+
+	statuses := make([]ClusterStatus, 0, len(clusters))
+	for _, cluster := range clusters {
+		sort.Slice(cluster.Members, func(i, j int) bool {
+			return memberLess(cluster.Members[i].Name, cluster.Members[j].Name)
+		})
+		statuses = append(statuses, *cluster)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// memberLess orders "<prefix>-2" before "<prefix>-10".
+func memberLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func newestPod(pods []*coreV1.Pod) *coreV1.Pod {
+	var newest *coreV1.Pod
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		if newest == nil || newest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			newest = pod
+		}
+	}
+	return newest
+}
+
+func endpointAddresses(endpoints *coreV1.Endpoints) []string {
+	if endpoints == nil {
+		return nil
+	}
+	var addresses []string
+	for _, subset := range endpoints.Subsets {
+		for _, port := range subset.Ports {
+			for _, address := range subset.Addresses {
+				addresses = append(addresses, fmt.Sprintf("%s:%d", address.IP, port.Port))
+			}
+			for _, address := range subset.NotReadyAddresses {
+				addresses = append(addresses, fmt.Sprintf("%s:%d (not ready)", address.IP, port.Port))
+			}
+		}
+	}
+	return addresses
+}
+
+func secretFingerprint(secret *coreV1.Secret) string {
+	if secret == nil {
+		return ""
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(secret.Data["id_rsa.pub"])
+	if err != nil {
+		return "invalid key"
+	}
+	return ssh.FingerprintSHA256(publicKey)
+}
+
+// PrintStatus writes the statuses as a table, JSON or YAML.
+func PrintStatus(
+	w io.Writer,
+	statuses []ClusterStatus,
+	output string) error {
+	switch output {
+	case "json":
+		data, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "yaml":
+		data, err := yaml.Marshal(statuses)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "---\n%s", data)
+		return err
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "CLUSTER\tMEMBER\tDEPLOYMENT\tPOD\tPHASE\tREADY\tNODE\tIP\tRESTARTS\tENDPOINTS\tFINGERPRINT")
+		for _, cluster := range statuses {
+			for _, m := range cluster.Members {
+				fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\t%s\t%t\t%s\t%s\t%d\t%s\t%s\n",
+					cluster.Name, m.Name, m.ReadyReplicas, m.Replicas,
+					orNone(m.Pod), orNone(m.Phase), m.Ready, orNone(m.Node), orNone(m.PodIP),
+					m.Restarts, orNone(strings.Join(m.Endpoints, ",")), orNone(m.Fingerprint))
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		return printRevokedKeys(w, statuses)
+	default:
+		return fmt.Errorf("unknown output format %q", output)
+	}
+}
+
+// printRevokedKeys adds a table of the revoked keys, if there are any, below
+// the member table.
+func printRevokedKeys(w io.Writer, statuses []ClusterStatus) error {
+	revoked := 0
+	for _, cluster := range statuses {
+		revoked += len(cluster.RevokedKeys)
+	}
+	if revoked == 0 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tREVOKED\tFINGERPRINT\tREVOKED AT")
+	for _, cluster := range statuses {
+		for _, key := range cluster.RevokedKeys {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", cluster.Name, key.Name, key.Fingerprint, orNone(key.RevokedAt))
+		}
+	}
+	return tw.Flush()
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
@@ -0,0 +1,84 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildClusterStatuses(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	_, publicKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	meta := func(name string) metaV1.ObjectMeta {
+		return metaV1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{clusterLabel: "sample", memberLabel: name},
+		}
+	}
+	deploys := []*appsV1.Deployment{
+		{ObjectMeta: meta("sample-10"), Status: appsV1.DeploymentStatus{Replicas: 1}},
+		{ObjectMeta: meta("sample-2"), Status: appsV1.DeploymentStatus{Replicas: 1, ReadyReplicas: 1}},
+	}
+	podMeta := meta("sample-2-abc")
+	podMeta.Labels[memberLabel] = "sample-2"
+	pods := []*coreV1.Pod{{
+		ObjectMeta: podMeta,
+		Spec:       coreV1.PodSpec{NodeName: "node-a"},
+		Status: coreV1.PodStatus{
+			Phase:             coreV1.PodRunning,
+			PodIP:             "10.0.0.2",
+			Conditions:        []coreV1.PodCondition{{Type: coreV1.PodReady, Status: coreV1.ConditionTrue}},
+			ContainerStatuses: []coreV1.ContainerStatus{{RestartCount: 3}},
+		},
+	}}
+	endpoints := []*coreV1.Endpoints{{
+		ObjectMeta: meta("sample-2"),
+		Subsets: []coreV1.EndpointSubset{{
+			Addresses: []coreV1.EndpointAddress{{IP: "10.0.0.2"}},
+			Ports:     []coreV1.EndpointPort{{Port: 22}},
+		}},
+	}}
+	secrets := []*coreV1.Secret{{
+		ObjectMeta: meta("sample-2"),
+		Data:       map[string][]byte{"id_rsa.pub": publicKey},
+	}}
+
+	statuses := buildClusterStatuses("ns", deploys, pods, endpoints, secrets, nil)
+	g.Expect(statuses).To(gomega.HaveLen(1))
+	g.Expect(statuses[0].Healthy()).To(gomega.BeFalse())
+	members := statuses[0].Members
+	g.Expect(members).To(gomega.HaveLen(2))
+	g.Expect(members[0].Name).To(gomega.Equal("sample-2"))
+	g.Expect(members[0].Ready).To(gomega.BeTrue())
+	g.Expect(members[0].Node).To(gomega.Equal("node-a"))
+	g.Expect(members[0].Restarts).To(gomega.Equal(int32(3)))
+	g.Expect(members[0].Endpoints).To(gomega.Equal([]string{"10.0.0.2:22"}))
+	g.Expect(members[0].Fingerprint).To(gomega.HavePrefix("SHA256:"))
+	g.Expect(members[1].Name).To(gomega.Equal("sample-10"))
+	g.Expect(members[1].Pod).To(gomega.BeEmpty())
+
+	for _, output := range []string{"table", "json", "yaml"} {
+		var buf bytes.Buffer
+		g.Expect(PrintStatus(&buf, statuses, output)).To(gomega.Succeed())
+		g.Expect(buf.String()).To(gomega.ContainSubstring("sample-10"))
+	}
+	g.Expect(PrintStatus(&bytes.Buffer{}, statuses, "xml")).NotTo(gomega.Succeed())
+}
+
+func TestWatchStatusStops(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	provisioner, _ := newFakeProvisioner()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	g.Expect(provisioner.WatchStatus(ctx, "ns", "sample", func([]ClusterStatus) {})).To(gomega.Succeed())
+	// Cancelling does not wait out the debounce of the first report.
+	g.Expect(time.Since(start)).To(gomega.BeNumerically("<", statusDebounce))
+}
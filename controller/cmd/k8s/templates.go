@@ -0,0 +1,181 @@
+package k8s
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/golang/glog"
+	"github.com/zicongmei/kubernetes-ssh/controller/cmd/k8s/yamlDecoder"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+//go:embed all:templates
+var embeddedTemplates embed.FS
+
+const (
+	systemTemplate     = "systemObjs.yaml"
+	clusterTemplate    = "clusterObjs.yaml"
+	podTemplate        = "podObjs.yaml"
+	usersTemplate      = "usersObjs.yaml"
+	loginUsersTemplate = "pod-login-users.sh"
+	bootstraptTemplate = "pod-bootstrapt.sh"
+	installTemplate    = "installObjs.yaml"
+	// helperPattern matches the files of a templates directory whose
+	// definitions are available to every template.
+	helperPattern = "*.tpl"
+)
+
+// templateFuncs are the helpers available to every template, named after
+// their Helm counterparts.
+var templateFuncs = template.FuncMap{
+	"indent": func(spaces int, s string) string {
+		pad := strings.Repeat(" ", spaces)
+		return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+	// squote quotes a string for the shell.
+	"squote": func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	},
+	"b64enc": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"toYaml": func(v interface{}) (string, error) {
+		out, err := yaml.Marshal(v)
+		return strings.TrimSuffix(string(out), "\n"), err
+	},
+	// default returns value unless it is empty, e.g. {{ .X | default "y" }}.
+	"default": func(fallback interface{}, value interface{}) interface{} {
+		if value == nil || reflect.ValueOf(value).IsZero() {
+			return fallback
+		}
+		return value
+	},
+}
+
+// templateLine finds the line in the errors of text/template, which read
+// "template: name:line: ..." or "template: name:line:column: ...".
+var templateLine = regexp.MustCompile(`^template: [^:]+:(\d+):`)
+
+// readTemplate returns the file name from dir, or the embedded file of that
+// name when dir is empty or has no such file. path says where it came from.
+func readTemplate(dir string, name string) (content string, path string, err error) {
+	if dir != "" {
+		path := filepath.Join(dir, name)
+		content, err := os.ReadFile(path)
+		if err == nil {
+			return string(content), path, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", path, &TemplateError{Template: name, Path: path, Err: err}
+		}
+	}
+	path = "templates/" + name
+	embedded, err := embeddedTemplates.ReadFile(path)
+	if err != nil {
+		return "", path, &TemplateError{Template: name, Path: path, Err: err}
+	}
+	return string(embedded), "embedded " + path, nil
+}
+
+// parseTemplate parses a template together with the helper files of dir.
+func parseTemplate(dir string, name string) (*template.Template, string, error) {
+	text, path, err := readTemplate(dir, name)
+	if err != nil {
+		return nil, path, err
+	}
+	tmpl := template.New(name).Funcs(templateFuncs)
+	if dir != "" {
+		helpers, err := filepath.Glob(filepath.Join(dir, helperPattern))
+		if err != nil {
+			return nil, path, &TemplateError{Template: name, Path: path, Err: err}
+		}
+		sort.Strings(helpers)
+		for _, helper := range helpers {
+			content, err := os.ReadFile(helper)
+			if err != nil {
+				return nil, path, &TemplateError{Template: name, Path: helper, Err: err}
+			}
+			if _, err := tmpl.New(filepath.Base(helper)).Parse(string(content)); err != nil {
+				return nil, path, newTemplateError(name, helper, "failed to parse", err)
+			}
+		}
+	}
+	if _, err := tmpl.Parse(text); err != nil {
+		return nil, path, newTemplateError(name, path, "failed to parse", err)
+	}
+	return tmpl, path, nil
+}
+
+// renderTemplate executes a template, from dir or embedded, and decodes the
+// resulting documents.
+func renderTemplate(
+	dir string,
+	name string,
+	data TemplateData) ([]*unstructured.Unstructured, error) {
+	rendered, path, err := executeTemplate(dir, name, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRendered(name, path, rendered)
+}
+
+// executeTemplate executes a template, from dir or embedded, and returns
+// the output together with where the template came from.
+func executeTemplate(dir string, name string, data TemplateData) (string, string, error) {
+	tmpl, path, err := parseTemplate(dir, name)
+	if err != nil {
+		return "", path, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", path, newTemplateError(name, path, "failed to execute", err)
+	}
+	glog.V(2).Infof("rendered %s:\n%s", name, buf.String())
+	return buf.String(), path, nil
+}
+
+// decodeRendered decodes the rendered output, which -v=2 logs, and checks
+// the kinds client-go knows against their schemas so a typo in a template
+// fails here rather than at the API server. Errors name the line of the
+// rendered output.
+func decodeRendered(name string, path string, rendered string) ([]*unstructured.Unstructured, error) {
+	objs, err := yamlDecoder.DecodeReader(strings.NewReader(rendered))
+	if err == nil {
+		_, err = yamlDecoder.DecodeStrict(strings.NewReader(rendered), scheme.Scheme)
+	}
+	var decodeErr *yamlDecoder.DecodeError
+	if !errors.As(err, &decodeErr) {
+		return objs, err
+	}
+	for _, docErr := range decodeErr.Errors {
+		// Other kinds are left to the API server.
+		if runtime.IsNotRegisteredError(docErr.Err) {
+			continue
+		}
+		return nil, &TemplateError{Template: name, Path: path, Err: fmt.Errorf(
+			"failed to decode line %d of the rendered output: %w", docErr.Line, docErr.Err)}
+	}
+	return objs, nil
+}
+
+func newTemplateError(name string, path string, what string, err error) *TemplateError {
+	templateErr := &TemplateError{Template: name, Path: path, Err: fmt.Errorf("%s: %w", what, err)}
+	if match := templateLine.FindStringSubmatch(err.Error()); match != nil {
+		templateErr.Line, _ = strconv.Atoi(match[1])
+	}
+	return templateErr
+}
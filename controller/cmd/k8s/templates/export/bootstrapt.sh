@@ -0,0 +1,21 @@
+#!/bin/bash
+set -ex
+
+# Seed a fresh persistent home with the default dotfiles.
+[ -f /root/.profile ] || cp -rT /etc/skel /root
+
+# /tmp/keys holds the private key of every member. Only this init container
+# mounts it: the member keeps its own key and trusts the public keys of all.
+mkdir -p /root/.ssh
+chmod 700 /root/.ssh
+: > /root/.ssh/authorized_keys
+for key in /tmp/keys/*; do
+  ssh-keygen -y -f "$key" >> /root/.ssh/authorized_keys
+done
+cat "/tmp/keys/$MEMBER" > /root/.ssh/id_rsa
+chmod 600 /root/.ssh/id_rsa
+ssh-keygen -y -f /root/.ssh/id_rsa > /root/.ssh/id_rsa.pub
+chmod 640 /root/.ssh/id_rsa.pub
+chmod 600 /root/.ssh/authorized_keys
+# sshd gets a host key of its own, the member key is handed out to clients.
+[ -f /root/.ssh/ssh_host_key ] || ssh-keygen -q -t ecdsa -N "" -f /root/.ssh/ssh_host_key
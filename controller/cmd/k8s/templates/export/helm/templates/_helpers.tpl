@@ -0,0 +1,19 @@
+{{- define "kssh.labels" -}}
+cluster: {{ .Values.namePrefix }}
+app.kubernetes.io/instance: {{ .Release.Name }}
+app.kubernetes.io/managed-by: {{ .Release.Service }}
+{{- end }}
+
+{{- define "kssh.keysSecret" -}}
+{{ .Values.keys.existingSecret | default (printf "%s-keys" .Values.namePrefix) }}
+{{- end }}
+
+{{- define "kssh.probe" -}}
+exec:
+  command:
+  - bash
+  - -c
+  - exec 3<>/dev/tcp/127.0.0.1/{{ .Values.port }} && read -t {{ .Values.probe.timeoutSeconds }} banner <&3 && [[ $banner == SSH-* ]]
+periodSeconds: {{ .Values.probe.periodSeconds }}
+timeoutSeconds: {{ .Values.probe.timeoutSeconds }}
+{{- end }}
@@ -0,0 +1,12 @@
+#!/bin/sh
+# Generates the member keys missing from keys/ for the secretGenerator.
+set -e
+cd "$(dirname "$0")"
+mkdir -p keys
+chmod 700 keys
+for member in{{ range .Members }} {{ . }}{{ end }}; do
+  if [ ! -f "keys/$member" ]; then
+    ssh-keygen -q -t rsa -b 4096 -m PEM -N "" -C "$member" -f "keys/$member"
+    rm "keys/$member.pub"
+  fi
+done
@@ -1,11 +1,21 @@
 #!/bin/bash
 set -ex
 
-mkdir -p /root/.ssh
-chmod 700 /root/.ssh
-cat /tmp/ssh/id_rsa > /root/.ssh/id_rsa
-cat /tmp/ssh/id_rsa.pub > /root/.ssh/id_rsa.pub
-cat /tmp/ssh/authorized_keys > /root/.ssh/authorized_keys
-chmod 600 /root/.ssh/id_rsa
-chmod 640 /root/.ssh/id_rsa.pub
-chmod 600 /root/.ssh/authorized_keys
+# HOME is /root unless the member runs as another user.
+home=${HOME:-/root}
+
+# Seed a fresh persistent home with the default dotfiles.
+[ -f "$home/.profile" ] || cp -rT /etc/skel "$home"
+
+mkdir -p "$home/.ssh"
+# A volume mounted at .ssh stays root's when the member runs as another user,
+# sshd then runs with StrictModes off.
+if [ -O "$home/.ssh" ]; then
+  chmod 700 "$home/.ssh"
+fi
+cat /tmp/ssh/id_rsa > "$home/.ssh/id_rsa"
+cat /tmp/ssh/id_rsa.pub > "$home/.ssh/id_rsa.pub"
+cat /tmp/ssh/authorized_keys > "$home/.ssh/authorized_keys"
+chmod 600 "$home/.ssh/id_rsa"
+chmod 640 "$home/.ssh/id_rsa.pub"
+chmod 600 "$home/.ssh/authorized_keys"
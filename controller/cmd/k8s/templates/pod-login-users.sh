@@ -0,0 +1,40 @@
+#!/bin/bash
+# Creates the login users. It runs when the sshd container starts, as the
+# accounts have to exist in the container sshd runs in.
+set -ex
+
+add_user() {
+  local name=$1 uid=$2 gid=$3 shell=$4 sudo=$5 members=$6 group=$1
+  if [ -n "$gid" ] && getent group "$gid" > /dev/null; then
+    group=$gid
+  elif ! getent group "$name" > /dev/null; then
+    groupadd ${gid:+--gid "$gid"} "$name"
+  fi
+  id -u "$name" > /dev/null 2>&1 ||
+    useradd --create-home --gid "$group" --shell "$shell" ${uid:+--uid "$uid"} "$name"
+  local home
+  home=$(getent passwd "$name" | cut -d: -f6)
+  mkdir -p "$home/.ssh"
+  # Only the account the members log in to each other as trusts their keys.
+  if [ "$members" = yes ]; then
+    { cat /root/.ssh/authorized_keys; cat; } > "$home/.ssh/authorized_keys"
+  else
+    cat > "$home/.ssh/authorized_keys"
+  fi
+  chown -R "$name:$group" "$home/.ssh"
+  chmod 700 "$home/.ssh"
+  chmod 600 "$home/.ssh/authorized_keys"
+  if [ "$sudo" = yes ]; then
+    command -v sudo > /dev/null || echo "sudo is not installed in the image" >&2
+    mkdir -p /etc/sudoers.d
+    echo "$name ALL=(ALL) NOPASSWD:ALL" > "/etc/sudoers.d/$name"
+    chmod 440 "/etc/sudoers.d/$name"
+  fi
+}
+{{ range .LoginUsers }}
+add_user {{ .Name | squote }} '{{ if .UID }}{{ .UID }}{{ end }}' '{{ if .GID }}{{ .GID }}{{ end }}' {{ .Shell | default "/bin/bash" | squote }} {{ if .Sudo }}yes{{ else }}no{{ end }} {{ if eq .Name $.LoginUser }}yes{{ else }}no{{ end }} <<'KEYS'
+{{- range .AuthorizedKeys }}
+{{ . }}
+{{- end }}
+KEYS
+{{- end }}
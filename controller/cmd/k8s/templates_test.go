@@ -0,0 +1,111 @@
+package k8s
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRenderBootstraptScript(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := DefaultClusterSpec()
+	objs, err := generateSystemObjs(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(objs).To(gomega.HaveLen(2))
+
+	script, _, err := readTemplate("", bootstraptTemplate)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	content, _, _ := unstructured.NestedString(objs[1].Object, "data", bootstraptKey)
+	g.Expect(content).To(gomega.Equal(script))
+}
+
+func TestRenderTemplatesDir(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"_helpers.tpl": `{{ define "labels" }}cluster: {{ .NamePrefix }}{{ end }}`,
+		podTemplate: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Name }}
+  namespace: {{ .Namespace }}
+  labels:
+    {{ template "labels" . }}
+data:
+  index: "{{ .Index }}"
+  image: {{ .Spec.Image | default "fallback" }}
+  key: {{ "secret" | b64enc }}
+  members: |
+{{ toYaml .Members | indent 4 }}
+`,
+		bootstraptTemplate: "#!/bin/sh\necho \"custom\"\n",
+	}
+	for name, content := range files {
+		g.Expect(os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)).To(gomega.Succeed())
+	}
+	spec := DefaultClusterSpec()
+	spec.TemplatesDir = dir
+
+	objs, err := renderAllPods(spec, emptySSHKeys(spec.PodNum))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(objs).To(gomega.HaveLen(2))
+	g.Expect(objs[1].GetName()).To(gomega.Equal("sample-1"))
+	g.Expect(objs[1].GetLabels()).To(gomega.Equal(map[string]string{"cluster": "sample"}))
+	data, _, _ := unstructured.NestedStringMap(objs[1].Object, "data")
+	g.Expect(data).To(gomega.Equal(map[string]string{
+		"index":   "1",
+		"image":   "fallback",
+		"key":     "c2VjcmV0",
+		"members": "- sample-0\n- sample-1\n",
+	}))
+
+	// The bootstrap script is overridden, the other templates are embedded.
+	objs, err = generateSystemObjs(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	content, _, _ := unstructured.NestedString(objs[1].Object, "data", bootstraptKey)
+	g.Expect(content).To(gomega.Equal(files[bootstraptTemplate]))
+	objs, err = generateClusterObjs(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(kindsOf(objs)).To(gomega.Equal([]string{"ConfigMap/sample-cluster", "NetworkPolicy/sample-ssh"}))
+}
+
+func TestRenderTemplateErrors(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, clusterTemplate)
+	spec := DefaultClusterSpec()
+	spec.TemplatesDir = dir
+
+	g.Expect(os.WriteFile(path, []byte("---\nkind: A\nname: {{ .Missing }}\n"), 0600)).To(gomega.Succeed())
+	_, err := generateClusterObjs(spec)
+	var templateErr *TemplateError
+	g.Expect(errors.As(err, &templateErr)).To(gomega.BeTrue())
+	g.Expect(templateErr.Path).To(gomega.Equal(path))
+	g.Expect(templateErr.Line).To(gomega.Equal(3))
+
+	g.Expect(os.WriteFile(path, []byte("---\nkind: A\n---\nkind: B\n  bad: [\n"), 0600)).To(gomega.Succeed())
+	_, err = generateClusterObjs(spec)
+	g.Expect(errors.As(err, &templateErr)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("line 5 of the rendered output"))
+
+	// Known kinds are checked against their schema, others are not.
+	g.Expect(os.WriteFile(path, []byte(`---
+apiVersion: example.com/v1
+kind: Custom
+spec: {any: thing}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .NamePrefix }}
+spec:
+  prots: []
+`), 0600)).To(gomega.Succeed())
+	_, err = generateClusterObjs(spec)
+	g.Expect(errors.As(err, &templateErr)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring(`line 11 of the rendered output: unknown field "spec.prots"`))
+}
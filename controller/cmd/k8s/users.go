@@ -0,0 +1,214 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// usersKeysDir is where the members mount the users ConfigMap. sshd
+	// reads it on every login, so kubelet updating the mount is enough for a
+	// change to take effect.
+	usersKeysDir = "/etc/kssh/users"
+	// userKeysTimeout bounds fetching the keys of one user from a URL.
+	userKeysTimeout = 30 * time.Second
+)
+
+func usersConfigMapName(spec ClusterSpec) string {
+	return spec.NamePrefix + "-users"
+}
+
+// usersKeysFile is the key of the users ConfigMap holding the keys of
+// spec.Users. They log in to the account the members log in to each other
+// as, and the file is named after it: sshd only reads the file of the
+// account being logged in to. Restricted sshd can only log in the account
+// it runs as, whose name the image decides, so its file has a fixed name.
+func usersKeysFile(spec ClusterSpec) string {
+	switch {
+	case spec.PodSecurity.Restricted:
+		return "authorized_keys"
+	case spec.loginUser() != "":
+		return spec.loginUser()
+	}
+	return "root"
+}
+
+// usersKeysPath is the AuthorizedKeysFile entry of the users ConfigMap.
+func usersKeysPath(spec ClusterSpec) string {
+	if spec.PodSecurity.Restricted {
+		return usersKeysDir + "/" + usersKeysFile(spec)
+	}
+	return usersKeysDir + "/%u"
+}
+
+// generateUsersObjs renders the users and revoked ConfigMaps. The revoked
+// keys are left out of the user keys.
+func generateUsersObjs(spec ClusterSpec, userKeys []byte, revokedKeys []byte) ([]*unstructured.Unstructured, error) {
+	data := newTemplateData(spec)
+	data.UserAuthorizedKeys = string(removeKeys(userKeys, revokedKeys))
+	data.UsersKeysFile = usersKeysFile(spec)
+	data.RevokedKeys = string(revokedKeys)
+	data.LoginUsers = withoutRevokedKeys(spec.LoginUsers, revokedKeys)
+	if len(spec.LoginUsers) != 0 {
+		script, _, err := executeTemplate(spec.TemplatesDir, loginUsersTemplate, data)
+		if err != nil {
+			return nil, err
+		}
+		data.LoginUsersScript = script
+	}
+	return renderTemplate(spec.TemplatesDir, usersTemplate, data)
+}
+
+// withoutRevokedKeys returns a copy of the login users without the keys in
+// revokedKeys.
+func withoutRevokedKeys(users []LoginUserSpec, revokedKeys []byte) []LoginUserSpec {
+	if len(revokedKeys) == 0 {
+		return users
+	}
+	filtered := make([]LoginUserSpec, len(users))
+	for i, user := range users {
+		filtered[i] = user
+		filtered[i].AuthorizedKeys = nil
+		for _, key := range user.AuthorizedKeys {
+			if len(removeKeys([]byte(key), revokedKeys)) != 0 {
+				filtered[i].AuthorizedKeys = append(filtered[i].AuthorizedKeys, key)
+			}
+		}
+	}
+	return filtered
+}
+
+// resolveUserKeys reads the keys of every user in spec.Users and returns
+// them as authorized_keys lines carrying the user's options.
+func (p *Provisioner) resolveUserKeys(ctx context.Context, spec ClusterSpec) ([]byte, error) {
+	var b bytes.Buffer
+	for _, user := range spec.Users {
+		content, err := p.readUserKeys(ctx, spec.Namespace, user)
+		if err != nil {
+			return nil, &KeyError{Err: fmt.Errorf("user %q: %w", user.Name, err)}
+		}
+		fmt.Fprintf(&b, "# %s\n", user.Name)
+		keys := 0
+		for i, line := range strings.Split(content, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			publicKey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, &KeyError{Err: fmt.Errorf("user %q: line %d: %w", user.Name, i+1, err)}
+			}
+			if comment == "" {
+				comment = user.Name
+			}
+			options = append(options, user.options()...)
+			if len(options) != 0 {
+				fmt.Fprintf(&b, "%s ", strings.Join(options, ","))
+			}
+			fmt.Fprintf(&b, "%s %s\n", bytes.TrimSpace(ssh.MarshalAuthorizedKey(publicKey)), comment)
+			keys++
+		}
+		if keys == 0 {
+			glog.Warningf("user %q has no keys", user.Name)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// options returns the sshd options of the user's keys.
+func (u *UserKeySpec) options() []string {
+	var options []string
+	if len(u.From) != 0 {
+		options = append(options, fmt.Sprintf(`from="%s"`, strings.Join(u.From, ",")))
+	}
+	if u.Command != "" {
+		options = append(options, fmt.Sprintf(`command="%s"`, strings.ReplaceAll(u.Command, `"`, `\"`)))
+	}
+	if u.ExpiryTime != "" {
+		options = append(options, fmt.Sprintf(`expiry-time="%s"`, u.ExpiryTime))
+	}
+	return options
+}
+
+// readUserKeys returns the authorized_keys content of the user's source.
+func (p *Provisioner) readUserKeys(ctx context.Context, namespace string, user UserKeySpec) (string, error) {
+	switch {
+	case user.File != "":
+		content, err := os.ReadFile(user.File)
+		return string(content), err
+	case user.URL != "":
+		return fetchUserKeys(ctx, user.URL)
+	case user.ConfigMapRef != nil:
+		client := p.clients.GetControllerClient()
+		configMap := &coreV1.ConfigMap{}
+		key := types.NamespacedName{Namespace: namespace, Name: user.ConfigMapRef.Name}
+		if err := client.Get(ctx, key, configMap); err != nil {
+			return "", &APIError{Verb: "get", Kind: "ConfigMap", Name: key.Name, Err: err}
+		}
+		content, ok := configMap.Data[user.ConfigMapRef.Key]
+		if !ok {
+			return "", fmt.Errorf("ConfigMap %q has no key %q", key.Name, user.ConfigMapRef.Key)
+		}
+		return content, nil
+	}
+	return user.Key, nil
+}
+
+func fetchUserKeys(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, userKeysTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", url, response.Status)
+	}
+	content, err := io.ReadAll(response.Body)
+	return string(content), err
+}
+
+// SyncUsers writes the keys of spec.Users to the users ConfigMap of a
+// running cluster. Members pick the change up once kubelet has updated
+// their mount, usually within a minute, without being restarted.
+func (p *Provisioner) SyncUsers(ctx context.Context, spec ClusterSpec) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	userKeys, err := p.resolveUserKeys(ctx, spec)
+	if err != nil {
+		return err
+	}
+	revokedKeys, err := p.revokedKeys(ctx, spec)
+	if err != nil {
+		return err
+	}
+	objs, err := generateUsersObjs(spec, userKeys, revokedKeys)
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if err := p.createOrUpdate(ctx, o); err != nil {
+			return err
+		}
+		glog.Infof("synced %q object %q with %d users", o.GetKind(), o.GetName(), len(spec.Users))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/onsi/gomega"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSyncUsers(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	var keys []string
+	for i := 0; i < 4; i++ {
+		_, publicKey, err := generateSSHKey()
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		keys = append(keys, strings.TrimSpace(string(publicKey)))
+	}
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/carol.keys" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(keys[2] + "\n"))
+	}))
+	defer mirror.Close()
+	file := filepath.Join(t.TempDir(), "bob.pub")
+	g.Expect(os.WriteFile(file, []byte(keys[1]+" bob@laptop\n"), 0600)).To(gomega.Succeed())
+	team := &coreV1.ConfigMap{
+		ObjectMeta: metaV1.ObjectMeta{Namespace: "ns", Name: "team"},
+		Data:       map[string]string{"dave": "# dave\n" + keys[3]},
+	}
+	provisioner, client := newFakeProvisioner(team)
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 1, Probe: DefaultProbeSpec()}
+	spec.Users = []UserKeySpec{
+		{Name: "alice", Key: keys[0], From: []string{"10.0.0.0/8", "*.corp"}, ExpiryTime: "20301231"},
+		{Name: "bob", File: file, Command: `echo "hi"`},
+		{Name: "carol", URL: mirror.URL + "/carol.keys"},
+		{Name: "dave", ConfigMapRef: &ConfigMapKey{Name: "team", Key: "dave"}},
+	}
+
+	// The users ConfigMap is created when missing.
+	g.Expect(provisioner.SyncUsers(ctx, spec)).To(gomega.Succeed())
+	configMap := &coreV1.ConfigMap{}
+	key := types.NamespacedName{Namespace: "ns", Name: "sample-users"}
+	g.Expect(client.Get(ctx, key, configMap)).To(gomega.Succeed())
+	// They log in as root, the only account reading them.
+	g.Expect(configMap.Data["root"]).To(gomega.Equal(strings.Join([]string{
+		"# alice",
+		`from="10.0.0.0/8,*.corp",expiry-time="20301231" ` + keys[0] + " alice",
+		"# bob",
+		`command="echo \"hi\"" ` + keys[1] + " bob@laptop",
+		"# carol",
+		keys[2] + " carol",
+		"# dave",
+		keys[3] + " dave",
+	}, "\n") + "\n"))
+
+	// Removing a user updates it in place.
+	spec.Users = spec.Users[2:3]
+	g.Expect(provisioner.SyncUsers(ctx, spec)).To(gomega.Succeed())
+	g.Expect(client.Get(ctx, key, configMap)).To(gomega.Succeed())
+	g.Expect(configMap.Data["root"]).To(gomega.Equal("# carol\n" + keys[2] + " carol\n"))
+
+	spec.Users = []UserKeySpec{{Name: "erin", URL: mirror.URL + "/erin.keys"}}
+	err := provisioner.SyncUsers(ctx, spec)
+	var keyErr *KeyError
+	g.Expect(errors.As(err, &keyErr)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("404"))
+}
+
+func TestValidateUsers(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec := DefaultClusterSpec()
+	spec.Users = []UserKeySpec{
+		{Name: "alice", Key: "k", File: "f"},
+		{Name: "alice", URL: "ftp://mirror/alice.keys"},
+		{Name: "bob", Key: "k", From: []string{"a,b"}, ExpiryTime: "tomorrow"},
+		{Name: "carol"},
+	}
+	err := spec.Validate()
+	var validationErr *ValidationError
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+	var fields []string
+	for _, e := range validationErr.Errors {
+		fields = append(fields, e.Field)
+	}
+	g.Expect(fields).To(gomega.Equal([]string{
+		"users[0]", "users[1].url", "users[1].name", "users[2].from[0]", "users[2].expiryTime", "users[3]",
+	}))
+}
+
+func TestLoginUsers(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	_, publicKey, err := generateSSHKey()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	key := strings.TrimSpace(string(publicKey))
+	spec := DefaultClusterSpec()
+	spec.LoginUsers = []LoginUserSpec{
+		{Name: "alice", UID: 2000, Shell: "/bin/zsh", AuthorizedKeys: []string{key}, Sudo: true},
+		{Name: "bob", GID: 100},
+	}
+	g.Expect(spec.Validate()).To(gomega.Succeed())
+
+	objs, err := generateUsersObjs(spec, nil, nil)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	script, _, _ := unstructured.NestedString(objs[0].Object, "data", "login-users.sh")
+	// Only alice, whom the members log in as, trusts the member keys.
+	g.Expect(script).To(gomega.ContainSubstring("add_user 'alice' '2000' '' '/bin/zsh' yes yes <<'KEYS'\n" + key + "\nKEYS\n"))
+	g.Expect(script).To(gomega.ContainSubstring("add_user 'bob' '' '100' '/bin/bash' no no <<'KEYS'\nKEYS\n"))
+	g.Expect(objs[0].Object["data"]).To(gomega.HaveKey("alice"))
+	g.Expect(exec.Command("bash", "-n", "-c", script).Run()).To(gomega.Succeed())
+
+	objs, err = renderAllPods(spec, emptySSHKeys(spec.PodNum))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	deploy := &appsV1.Deployment{}
+	g.Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(objs[0].Object, deploy)).To(gomega.Succeed())
+	container := deploy.Spec.Template.Spec.Containers[0]
+	g.Expect(container.Command[0]).To(gomega.Equal("bash"))
+	g.Expect(container.Args).To(gomega.ContainElements("/usr/sbin/sshd", "PermitRootLogin=no",
+		"AuthorizedKeysFile=.ssh/authorized_keys /etc/kssh/users/%u"))
+	g.Expect(container.Env).To(gomega.ContainElement(coreV1.EnvVar{Name: "KSSH_LOGIN_USER", Value: "alice"}))
+
+	deploy = &appsV1.Deployment{}
+	// Without login users sshd runs directly and root may log in.
+	spec.LoginUsers = nil
+	objs, err = renderAllPods(spec, emptySSHKeys(spec.PodNum))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(objs[0].Object, deploy)).To(gomega.Succeed())
+	container = deploy.Spec.Template.Spec.Containers[0]
+	g.Expect(container.Command[0]).To(gomega.Equal("/usr/sbin/sshd"))
+	g.Expect(container.Command).NotTo(gomega.ContainElement("PermitRootLogin=no"))
+	// The scripts fall back to the account the members run as.
+	g.Expect(container.Env).To(gomega.BeEmpty())
+
+	spec.LoginUsers = []LoginUserSpec{{Name: "root"}, {Name: "Bad Name", Shell: "zsh", AuthorizedKeys: []string{"nope"}}}
+	var validationErr *ValidationError
+	g.Expect(errors.As(spec.Validate(), &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Errors).To(gomega.HaveLen(4))
+}
@@ -0,0 +1,321 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	diagnoseTimeout = 30 * time.Second
+	diagnoseLogTail = 20
+)
+
+// waitingFailureReasons are container waiting reasons that will not go away by
+// waiting longer.
+var waitingFailureReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"CrashLoopBackOff":           true,
+}
+
+// terminalWaitingReasons are the waiting reasons for which WaitForReady stops
+// early: kubelet only backs off retrying, which does not fix the image or
+// the command.
+var terminalWaitingReasons = map[string]bool{
+	"ImagePullBackOff": true,
+	"InvalidImageName": true,
+	"CrashLoopBackOff": true,
+}
+
+// WaitForReady watches the member pods until every member has a Ready pod or
+// the timeout expires. Ready is driven by the SSH banner readiness probe, so a
+// Ready member accepts SSH connections. It returns a *NotReadyError
+// explaining why each missing member is not ready on timeout, or as soon as
+// a member waits for one of terminalWaitingReasons.
+func (p *Provisioner) WaitForReady(
+	ctx context.Context,
+	spec ClusterSpec,
+	timeout time.Duration) error {
+	cs := p.clients.GetClientSet()
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	members := memberNames(spec)
+	pods := map[string]*coreV1.Pod{}
+	lastReady := -1
+	failed := ""
+	for {
+		list, err := cs.CoreV1().Pods(spec.Namespace).List(waitCtx, metaV1.ListOptions{
+			LabelSelector: clusterSelector(spec),
+		})
+		if err != nil {
+			if waitCtx.Err() != nil {
+				break
+			}
+			return &APIError{Verb: "list", Kind: "Pod", Err: err}
+		}
+		pods = map[string]*coreV1.Pod{}
+		for i := range list.Items {
+			pods[list.Items[i].Name] = &list.Items[i]
+		}
+		lastReady = reportProgress(members, pods, lastReady)
+		if lastReady == len(members) {
+			return nil
+		}
+		if failed = failingMember(members, pods); failed != "" {
+			break
+		}
+
+		watcher, err := cs.CoreV1().Pods(spec.Namespace).Watch(waitCtx, metaV1.ListOptions{
+			LabelSelector:   clusterSelector(spec),
+			ResourceVersion: list.ResourceVersion,
+		})
+		if err != nil {
+			if waitCtx.Err() != nil {
+				break
+			}
+			return &APIError{Verb: "watch", Kind: "Pod", Err: err}
+		}
+		for event := range watcher.ResultChan() {
+			pod, ok := event.Object.(*coreV1.Pod)
+			if !ok {
+				// Usually an expired resource version, start over with a list.
+				break
+			}
+			if event.Type == watch.Deleted {
+				delete(pods, pod.Name)
+			} else {
+				pods[pod.Name] = pod
+			}
+			lastReady = reportProgress(members, pods, lastReady)
+			if lastReady == len(members) {
+				watcher.Stop()
+				return nil
+			}
+			if failed = failingMember(members, pods); failed != "" {
+				break
+			}
+		}
+		watcher.Stop()
+		if failed != "" || waitCtx.Err() != nil {
+			break
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	diagnoseCtx, cancelDiagnose := context.WithTimeout(ctx, diagnoseTimeout)
+	defer cancelDiagnose()
+	notReady := &NotReadyError{
+		Cluster:   spec.NamePrefix,
+		Timeout:   timeout,
+		Failed:    failed,
+		Diagnoses: map[string]string{},
+	}
+	byMember := podsByMember(pods)
+	for _, member := range members {
+		if readyPod(byMember[member]) != nil {
+			continue
+		}
+		notReady.Diagnoses[member] = diagnoseMember(diagnoseCtx, cs, spec.Namespace, byMember[member])
+	}
+	return notReady
+}
+
+func memberNames(spec ClusterSpec) []string {
+	names := make([]string, 0, spec.PodNum)
+	for i := 0; i < spec.PodNum; i++ {
+		names = append(names, fmt.Sprintf("%s-%d", spec.NamePrefix, i))
+	}
+	return names
+}
+
+func clusterSelector(spec ClusterSpec) string {
+	return clusterLabel + "=" + spec.NamePrefix
+}
+
+func podsByMember(pods map[string]*coreV1.Pod) map[string][]*coreV1.Pod {
+	byMember := map[string][]*coreV1.Pod{}
+	for _, pod := range pods {
+		member := pod.Labels[memberLabel]
+		byMember[member] = append(byMember[member], pod)
+	}
+	for _, memberPods := range byMember {
+		// Newest first, the old pods of a rollout are the least interesting.
+		sort.Slice(memberPods, func(i, j int) bool {
+			return memberPods[j].CreationTimestamp.Before(&memberPods[i].CreationTimestamp)
+		})
+	}
+	return byMember
+}
+
+// reportProgress logs the number of ready members whenever it changes and
+// returns it.
+func reportProgress(members []string, pods map[string]*coreV1.Pod, lastReady int) int {
+	byMember := podsByMember(pods)
+	ready := 0
+	for _, member := range members {
+		if readyPod(byMember[member]) != nil {
+			ready++
+		}
+	}
+	if ready != lastReady {
+		glog.Infof("%d/%d members ready", ready, len(members))
+	}
+	return ready
+}
+
+func readyPod(pods []*coreV1.Pod) *coreV1.Pod {
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil && isPodReady(pod) {
+			return pod
+		}
+	}
+	return nil
+}
+
+// failingMember returns a member that is not ready and whose newest pod has
+// a container waiting for one of terminalWaitingReasons, or an empty string.
+func failingMember(members []string, pods map[string]*coreV1.Pod) string {
+	byMember := podsByMember(pods)
+	for _, member := range members {
+		memberPods := byMember[member]
+		if len(memberPods) == 0 || readyPod(memberPods) != nil {
+			continue
+		}
+		status := memberPods[0].Status
+		for _, statuses := range [][]coreV1.ContainerStatus{status.InitContainerStatuses, status.ContainerStatuses} {
+			for _, container := range statuses {
+				if waiting := container.State.Waiting; waiting != nil && terminalWaitingReasons[waiting.Reason] {
+					return member
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func isPodReady(pod *coreV1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == coreV1.PodReady {
+			return condition.Status == coreV1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// diagnoseMember explains why the newest pod of a member is not ready.
+func diagnoseMember(
+	ctx context.Context,
+	cs kubernetes.Interface,
+	namespace string,
+	pods []*coreV1.Pod) string {
+	if len(pods) == 0 {
+		return "no pod was created, check the Deployment and ReplicaSet events"
+	}
+	pod := pods[0]
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == coreV1.PodScheduled && condition.Status != coreV1.ConditionTrue {
+			return fmt.Sprintf("pod %s is not scheduled: %s %s%s",
+				pod.Name, condition.Reason, condition.Message, warningEvents(ctx, cs, pod))
+		}
+	}
+
+	for _, status := range pod.Status.InitContainerStatuses {
+		if reason := containerFailure(status); reason != "" {
+			return fmt.Sprintf("init container %s of pod %s failed: %s%s",
+				status.Name, pod.Name, reason, containerLogs(ctx, cs, pod, status))
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if reason := containerFailure(status); reason != "" {
+			return fmt.Sprintf("container %s of pod %s failed: %s%s",
+				status.Name, pod.Name, reason, containerLogs(ctx, cs, pod, status))
+		}
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == coreV1.PodReady && condition.Status != coreV1.ConditionTrue {
+			return fmt.Sprintf("pod %s is %s, %s %s%s",
+				pod.Name, pod.Status.Phase, condition.Reason, condition.Message, warningEvents(ctx, cs, pod))
+		}
+	}
+	return fmt.Sprintf("pod %s is %s%s", pod.Name, pod.Status.Phase, warningEvents(ctx, cs, pod))
+}
+
+// containerFailure returns why a container is failing, or an empty string if
+// it may still become ready.
+func containerFailure(status coreV1.ContainerStatus) string {
+	if waiting := status.State.Waiting; waiting != nil && waitingFailureReasons[waiting.Reason] {
+		return fmt.Sprintf("%s: %s", waiting.Reason, waiting.Message)
+	}
+	if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+		return fmt.Sprintf("exited with %d (%s)", terminated.ExitCode, terminated.Reason)
+	}
+	if terminated := status.LastTerminationState.Terminated; terminated != nil && terminated.ExitCode != 0 {
+		return fmt.Sprintf("restarted %d times, last exit with %d (%s)",
+			status.RestartCount, terminated.ExitCode, terminated.Reason)
+	}
+	return ""
+}
+
+// containerLogs returns the tail of the log of the last run of a container,
+// which for the init container is the output of pod-bootstrapt.sh.
+func containerLogs(
+	ctx context.Context,
+	cs kubernetes.Interface,
+	pod *coreV1.Pod,
+	status coreV1.ContainerStatus) string {
+	tail := int64(diagnoseLogTail)
+	options := &coreV1.PodLogOptions{
+		Container: status.Name,
+		TailLines: &tail,
+		// A container waiting to restart has no current log.
+		Previous: status.State.Terminated == nil && status.LastTerminationState.Terminated != nil,
+	}
+	logs, err := cs.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, options).DoRaw(ctx)
+	if err != nil {
+		return fmt.Sprintf("\n  (failed to get logs: %v)", err)
+	}
+	if len(logs) == 0 {
+		return ""
+	}
+	return "\n  last log lines:\n  " + strings.ReplaceAll(strings.TrimSpace(string(logs)), "\n", "\n  ")
+}
+
+// warningEvents returns the recent warning events of a pod, which carry the
+// scheduler and kubelet complaints.
+func warningEvents(
+	ctx context.Context,
+	cs kubernetes.Interface,
+	pod *coreV1.Pod) string {
+	events, err := cs.CoreV1().Events(pod.Namespace).List(ctx, metaV1.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s,type=%s",
+			pod.Name, coreV1.EventTypeWarning),
+	})
+	if err != nil {
+		return fmt.Sprintf("\n  (failed to list events: %v)", err)
+	}
+	var lines []string
+	for _, event := range events.Items {
+		lines = append(lines, fmt.Sprintf("%s: %s", event.Reason, event.Message))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return "\n  events:\n  " + strings.Join(lines, "\n  ")
+}
@@ -0,0 +1,89 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDiagnoseMember(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	pod := &coreV1.Pod{
+		ObjectMeta: metaV1.ObjectMeta{Namespace: "ns", Name: "sample-0-abc"},
+		Status: coreV1.PodStatus{
+			Phase: coreV1.PodPending,
+			Conditions: []coreV1.PodCondition{{
+				Type:    coreV1.PodScheduled,
+				Status:  coreV1.ConditionFalse,
+				Reason:  "Unschedulable",
+				Message: "0/3 nodes are available",
+			}},
+		},
+	}
+	cs := fake.NewSimpleClientset(pod)
+	g.Expect(diagnoseMember(ctx, cs, "ns", nil)).To(gomega.ContainSubstring("no pod"))
+	g.Expect(diagnoseMember(ctx, cs, "ns", []*coreV1.Pod{pod})).
+		To(gomega.ContainSubstring("Unschedulable 0/3 nodes are available"))
+
+	pod.Status.Conditions[0].Status = coreV1.ConditionTrue
+	pod.Status.InitContainerStatuses = []coreV1.ContainerStatus{{
+		Name: "sample-0-init",
+		State: coreV1.ContainerState{
+			Waiting: &coreV1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "not found"},
+		},
+	}}
+	g.Expect(diagnoseMember(ctx, cs, "ns", []*coreV1.Pod{pod})).
+		To(gomega.ContainSubstring("init container sample-0-init of pod sample-0-abc failed: ImagePullBackOff"))
+
+	pod.Status.InitContainerStatuses[0].State = coreV1.ContainerState{
+		Terminated: &coreV1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"},
+	}
+	g.Expect(diagnoseMember(ctx, cs, "ns", []*coreV1.Pod{pod})).
+		To(gomega.And(
+			gomega.ContainSubstring("exited with 1 (Error)"),
+			gomega.ContainSubstring("last log lines"),
+		))
+}
+
+func TestWaitForReadyFailsFast(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	spec := ClusterSpec{Namespace: "ns", NamePrefix: "sample", PodNum: 2, Probe: DefaultProbeSpec()}
+	pod := func(name string, member string, reason string) *coreV1.Pod {
+		return &coreV1.Pod{
+			ObjectMeta: metaV1.ObjectMeta{
+				Namespace: "ns",
+				Name:      name,
+				Labels:    map[string]string{clusterLabel: "sample", memberLabel: member},
+			},
+			Status: coreV1.PodStatus{
+				Phase: coreV1.PodPending,
+				ContainerStatuses: []coreV1.ContainerStatus{{
+					Name:  member,
+					State: coreV1.ContainerState{Waiting: &coreV1.ContainerStateWaiting{Reason: reason}},
+				}},
+			},
+		}
+	}
+	cs := fake.NewSimpleClientset(
+		pod("sample-0-abc", "sample-0", "ContainerCreating"),
+		pod("sample-1-abc", "sample-1", "ImagePullBackOff"),
+	)
+	provisioner := NewProvisioner(NewClients(nil, cs, nil))
+
+	start := time.Now()
+	err := provisioner.WaitForReady(ctx, spec, time.Hour)
+	g.Expect(time.Since(start)).To(gomega.BeNumerically("<", time.Minute))
+	var notReady *NotReadyError
+	g.Expect(errors.As(err, &notReady)).To(gomega.BeTrue())
+	g.Expect(notReady.Failed).To(gomega.Equal("sample-1"))
+	g.Expect(notReady.Diagnoses).To(gomega.HaveKeyWithValue("sample-1", gomega.ContainSubstring("ImagePullBackOff")))
+	g.Expect(notReady.Diagnoses).To(gomega.HaveKey("sample-0"))
+}
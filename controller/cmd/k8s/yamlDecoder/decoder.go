@@ -1,31 +1,270 @@
 package yamlDecoder
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
+	"gopkg.in/yaml.v3"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/json"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 )
 
-const decoderBufferSizeBytes = 10000
+// DocumentError is an error in one document of the input.
+type DocumentError struct {
+	// Index counts the documents of the input from 0.
+	Index int
+	// Line is the line of the input the error is on, or the first line of
+	// the document when the error has no position.
+	Line int
+	Err  error
+}
+
+func (e *DocumentError) Error() string {
+	return fmt.Sprintf("document %d, line %d: %v", e.Index, e.Line, e.Err)
+}
+
+func (e *DocumentError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeError holds every error found in the input, in input order.
+type DecodeError struct {
+	Errors []*DocumentError
+}
+
+func (e *DecodeError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return "error in decode yaml: " + strings.Join(msgs, "; ")
+}
+
+// yamlErrorLine finds the line in the errors of the YAML parser, which is
+// relative to the document.
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// strictErrorPath finds the field in the errors of the strict decoder, e.g.
+// `unknown field "spec.containers[0].imagePullPolicyy"`.
+var strictErrorPath = regexp.MustCompile(`(?:unknown|duplicate) field "([^"]+)"`)
+
+// document is one document of the input and the line it starts on.
+type document struct {
+	index   int
+	line    int
+	content []byte
+}
 
 func Decode(input string) ([]*unstructured.Unstructured, error) {
-	decoder := yaml.NewYAMLOrJSONDecoder(strings.NewReader(input), decoderBufferSizeBytes)
+	return DecodeReader(strings.NewReader(input))
+}
 
+// DecodeReader decodes every document of r into an Unstructured, empty
+// documents are skipped. The input is read document by document so there
+// is no limit on its size. The error is a *DecodeError.
+func DecodeReader(r io.Reader) ([]*unstructured.Unstructured, error) {
 	var resources []*unstructured.Unstructured
+	decodeErr := &DecodeError{}
+	err := readDocuments(r, func(doc document) {
+		data, err := utilyaml.ToJSON(doc.content)
+		if err != nil {
+			decodeErr.Errors = append(decodeErr.Errors, doc.syntaxError(err))
+			return
+		}
+		var obj map[string]interface{}
+		if err := utiljson.Unmarshal(data, &obj); err != nil {
+			decodeErr.Errors = append(decodeErr.Errors, doc.error(doc.line, err))
+			return
+		}
+		if len(obj) != 0 {
+			resources = append(resources, &unstructured.Unstructured{Object: obj})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(decodeErr.Errors) != 0 {
+		return nil, decodeErr
+	}
+	return resources, nil
+}
+
+// DecodeStrict decodes every document of r into the typed object that
+// scheme registers for its apiVersion and kind. Unknown and duplicate fields,
+// values of the wrong type and kinds the scheme does not know are errors,
+// each reported with its document and line in a *DecodeError. Documents
+// with errors are left out of the result.
+func DecodeStrict(r io.Reader, scheme *runtime.Scheme) ([]runtime.Object, error) {
+	serializer := json.NewSerializerWithOptions(json.DefaultMetaFactory, scheme, scheme,
+		json.SerializerOptions{Yaml: true, Strict: true})
+	var objs []runtime.Object
+	decodeErr := &DecodeError{}
+	err := readDocuments(r, func(doc document) {
+		data, err := utilyaml.ToJSON(doc.content)
+		if err != nil {
+			decodeErr.Errors = append(decodeErr.Errors, doc.syntaxError(err))
+			return
+		}
+		if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+			return
+		}
+		obj, _, err := serializer.Decode(doc.content, nil, nil)
+		if err == nil {
+			objs = append(objs, obj)
+			return
+		}
+		if strictErr, ok := runtime.AsStrictDecodingError(err); ok {
+			var docErrs []*DocumentError
+			for _, fieldErr := range strictErr.Errors() {
+				docErrs = append(docErrs, doc.fieldError(fieldErr))
+			}
+			sort.SliceStable(docErrs, func(i, j int) bool { return docErrs[i].Line < docErrs[j].Line })
+			decodeErr.Errors = append(decodeErr.Errors, docErrs...)
+			return
+		}
+		decodeErr.Errors = append(decodeErr.Errors, doc.error(doc.line, err))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(decodeErr.Errors) != 0 {
+		return nil, decodeErr
+	}
+	return objs, nil
+}
+
+// readDocuments calls decode for every document of r, which are separated
+// by "---" lines. It only fails when r does.
+func readDocuments(r io.Reader, decode func(document)) error {
+	reader := bufio.NewReader(r)
+	doc := document{line: 1}
+	line := 0
 	for {
-		u := &unstructured.Unstructured{}
-		if err := decoder.Decode(u); err != nil {
-			if err == io.EOF {
-				break
+		text, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error in read yaml: %w", err)
+		}
+		if text != "" {
+			line++
+		}
+		if isSeparator(text) {
+			if doc.index != 0 || line != 1 {
+				decode(doc)
+				doc = document{index: doc.index + 1}
 			}
-			return nil, fmt.Errorf("error in decode yaml: %v", err)
+			doc.line = line + 1
+		} else {
+			doc.content = append(doc.content, text...)
 		}
-		if len(u.Object) != 0 {
-			resources = append(resources, u)
+		if err == io.EOF {
+			break
 		}
 	}
-	return resources, nil
+	decode(doc)
+	return nil
+}
+
+// isSeparator tells whether a line separates two documents. Like the
+// Kubernetes YAML reader, anything after the "---" is ignored.
+func isSeparator(line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+	return line == "---" || strings.HasPrefix(line, "--- ")
+}
+
+func (doc document) error(line int, err error) *DocumentError {
+	return &DocumentError{Index: doc.index, Line: line, Err: err}
+}
+
+// syntaxError moves the line of a YAML parser error from the document to the
+// input.
+func (doc document) syntaxError(err error) *DocumentError {
+	line := doc.line
+	if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+		relative, _ := strconv.Atoi(match[1])
+		line += relative - 1
+	}
+	return doc.error(line, err)
+}
+
+// fieldError finds the line of the field a strict decoding error is about.
+// Duplicate keys are found by the YAML parser, which has the line itself.
+func (doc document) fieldError(err error) *DocumentError {
+	match := strictErrorPath.FindStringSubmatch(err.Error())
+	if match == nil {
+		return doc.syntaxError(err)
+	}
+	line := doc.line
+	var root yaml.Node
+	if yaml.Unmarshal(doc.content, &root) == nil {
+		if found := findLine(&root, match[1]); found != 0 {
+			line += found - 1
+		}
+	}
+	return doc.error(line, err)
+}
+
+// fieldPathPart matches one part of a field path, a name and its index.
+var fieldPathPart = regexp.MustCompile(`^([^.\[]*)(?:\[(\d+)\])?\.?`)
+
+// findLine returns the line of the node at a path such as
+// "spec.containers[0].name", or of its deepest existing parent. The line is
+// 0 when not even the first part exists.
+func findLine(node *yaml.Node, path string) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) != 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for path != "" {
+		match := fieldPathPart.FindStringSubmatch(path)
+		if match == nil || match[0] == "" {
+			break
+		}
+		path = path[len(match[0]):]
+		if match[1] != "" {
+			value := mappingValue(node, match[1])
+			if value == nil {
+				return line
+			}
+			line = value.key.Line
+			node = value.value
+		}
+		if match[2] != "" {
+			index, _ := strconv.Atoi(match[2])
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return line
+			}
+			node = node.Content[index]
+			line = node.Line
+		}
+	}
+	return line
+}
+
+type mappingEntry struct {
+	key   *yaml.Node
+	value *yaml.Node
+}
+
+// mappingValue returns the last entry of a mapping with the given key, the
+// one the decoder keeps when the key is duplicated.
+func mappingValue(node *yaml.Node, key string) *mappingEntry {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	var entry *mappingEntry
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			entry = &mappingEntry{key: node.Content[i], value: node.Content[i+1]}
+		}
+	}
+	return entry
 }
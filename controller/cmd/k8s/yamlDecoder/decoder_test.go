@@ -1,10 +1,16 @@
 package yamlDecoder_test
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/onsi/gomega"
 	"github.com/zicongmei/kubernetes-ssh/controller/cmd/k8s/yamlDecoder"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
 )
 
 func TestDecoder(t *testing.T) {
@@ -49,3 +55,80 @@ spec:
 	g.Expect(objs[0].GetKind()).To(gomega.Equal("PersistentVolumeClaim"))
 	g.Expect(objs[1].GetKind()).To(gomega.Equal("Pod"))
 }
+
+func TestDecodeReaderLarge(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	// A single document far beyond any fixed buffer.
+	var b strings.Builder
+	b.WriteString("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: big\ndata:\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&b, "  key%d: %q\n", i, strings.Repeat("x", 10))
+	}
+	objs, err := yamlDecoder.DecodeReader(strings.NewReader("---\n" + b.String() + "---\n# empty\n"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(objs).To(gomega.HaveLen(1))
+	data, _, _ := unstructured.NestedStringMap(objs[0].Object, "data")
+	g.Expect(data).To(gomega.HaveLen(20000))
+
+	_, err = yamlDecoder.DecodeReader(strings.NewReader("kind: A\n---\nkind: B\n  bad: [\n"))
+	var decodeErr *yamlDecoder.DecodeError
+	g.Expect(errors.As(err, &decodeErr)).To(gomega.BeTrue())
+	g.Expect(decodeErr.Errors).To(gomega.HaveLen(1))
+	g.Expect(decodeErr.Errors[0].Index).To(gomega.Equal(1))
+	g.Expect(decodeErr.Errors[0].Line).To(gomega.Equal(4))
+}
+
+func TestDecodeStrict(t *testing.T) {
+	input := `apiVersion: v1
+kind: Service
+metadata:
+  name: demo
+spec:
+  ports:
+  - port: 22
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: demo
+spec:
+  selector:
+    matchLabels:
+      app: demo
+  template:
+    spec:
+      containers:
+      - name: ssh
+        image: nginx
+      - name: typo
+        imagePullPolicyy: Always
+  replica: 2
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: demo
+  name: again
+---
+apiVersion: example.com/v1
+kind: Unknown
+`
+	g := gomega.NewGomegaWithT(t)
+	objs, err := yamlDecoder.DecodeStrict(strings.NewReader(input[:strings.Index(input, "---")]), scheme.Scheme)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(objs).To(gomega.HaveLen(1))
+	service, ok := objs[0].(*corev1.Service)
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(service.Spec.Ports[0].Port).To(gomega.Equal(int32(22)))
+
+	_, err = yamlDecoder.DecodeStrict(strings.NewReader(input), scheme.Scheme)
+	var decodeErr *yamlDecoder.DecodeError
+	g.Expect(errors.As(err, &decodeErr)).To(gomega.BeTrue())
+	type position struct{ Index, Line int }
+	var positions []position
+	for _, docErr := range decodeErr.Errors {
+		positions = append(positions, position{docErr.Index, docErr.Line})
+	}
+	g.Expect(positions).To(gomega.Equal([]position{{1, 23}, {1, 24}, {2, 30}, {3, 32}}))
+	g.Expect(decodeErr.Errors[0].Error()).To(gomega.ContainSubstring("imagePullPolicyy"))
+}
@@ -1,47 +1,634 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
-	"path"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/zicongmei/kubernetes-ssh/controller/cmd/k8s"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
+	specFlag string
+
 	namespaceFlag  string
 	podNumFlag     int
 	kubeconfigFlag string
 	namePrefixFlag string
+	imageFlag      string
+	templatesFlag  string
+
+	contextFlag string
+	userFlag    string
+	clusterFlag string
+	asFlag      string
+	asGroupFlag string
+
+	persistenceFlag  bool
+	homeSizeFlag     string
+	storageClassFlag string
+	retentionFlag    string
+
+	networkPolicyFlag     bool
+	allowedCIDRsFlag      string
+	allowedNamespacesFlag string
+
+	probeFlags = k8s.DefaultProbeSpec()
+
+	memberKeysDirFlag       string
+	memberKeysFlag          string
+	trustedKeysFlag         string
+	keyRotationIntervalFlag time.Duration
+
+	restrictedFlag bool
+	runAsUserFlag  int64
+	sshPortFlag    int
+
+	waitFlag        bool
+	waitTimeoutFlag time.Duration
+
+	onFailureFlag     string
+	resumeFlag        bool
+	skipPreflightFlag bool
+
+	workersFlag int
+	qpsFlag     float64
+	burstFlag   int
 )
 
 func init() {
-	defaultKubeconfigPath := path.Join(os.Getenv("HOME"), ".kube/config")
-	flag.StringVar(&namespaceFlag, "namespace", "default", "Namespace.")
-	flag.StringVar(&namePrefixFlag, "name_prefix", "sample", "Prefix of names.")
-	flag.IntVar(&podNumFlag, "pod_num", 2, "Number of pods.")
-	flag.StringVar(&kubeconfigFlag, "kubeconfig", defaultKubeconfigPath, "Path to the kubeconfig.")
+	defaults := k8s.DefaultClusterSpec()
+	flag.StringVar(&specFlag, "spec", "", "Path to an SSHCluster spec file. Flags given explicitly override its values.")
+	flag.StringVar(&namespaceFlag, "namespace", defaults.Namespace, "Namespace.")
+	flag.StringVar(&namePrefixFlag, "name_prefix", defaults.NamePrefix, "Prefix of names.")
+	flag.IntVar(&podNumFlag, "pod_num", defaults.PodNum, "Number of pods.")
+	flag.StringVar(&imageFlag, "image", "", "Image running sshd. Empty means the default image.")
+	flag.StringVar(&templatesFlag, "templates_dir", "", "Directory whose templates replace the embedded ones of the same name.")
+	flag.StringVar(&kubeconfigFlag, "kubeconfig", "", "Path to the kubeconfig. Empty means $KUBECONFIG, ~/.kube/config or the in-cluster config.")
+	flag.StringVar(&contextFlag, "context", "", "Kubeconfig context to use instead of the current one.")
+	flag.StringVar(&userFlag, "user", "", "Kubeconfig user to use instead of the one of the context.")
+	flag.StringVar(&clusterFlag, "cluster", "", "Kubeconfig cluster to use instead of the one of the context.")
+	flag.StringVar(&asFlag, "as", "", "User to impersonate.")
+	flag.StringVar(&asGroupFlag, "as_group", "", "Comma separated groups to impersonate.")
+	flag.BoolVar(&persistenceFlag, "persistence", defaults.Persistence.Enabled, "Give each pod a PVC for its home directory.")
+	flag.StringVar(&homeSizeFlag, "home_size", defaults.Persistence.Size, "Size of each home directory PVC.")
+	flag.StringVar(&storageClassFlag, "storage_class", "", "StorageClass of the home directory PVCs. Empty means the cluster default.")
+	flag.StringVar(&retentionFlag, "retention", string(defaults.Persistence.RetentionPolicy), "What to do with the home directory PVCs on delete: keep or delete.")
+	flag.BoolVar(&networkPolicyFlag, "network_policy", defaults.NetworkPolicy.Enabled, "Restrict SSH ingress with a NetworkPolicy. Disable it when the CNI does not enforce policies.")
+	flag.StringVar(&allowedCIDRsFlag, "allowed_cidrs", "", "Comma separated CIDRs that may also reach SSH, e.g. bastions.")
+	flag.StringVar(&allowedNamespacesFlag, "allowed_namespaces", "", "Comma separated namespaces whose pods may also reach SSH.")
+	flag.IntVar(&probeFlags.PeriodSeconds, "probe_period", probeFlags.PeriodSeconds, "Seconds between two SSH banner probes.")
+	flag.IntVar(&probeFlags.TimeoutSeconds, "probe_timeout", probeFlags.TimeoutSeconds, "Seconds to wait for the SSH banner.")
+	flag.IntVar(&probeFlags.StartupFailureThreshold, "startup_failure_threshold", probeFlags.StartupFailureThreshold, "Failed probes before sshd is considered not started.")
+	flag.IntVar(&probeFlags.ReadinessFailureThreshold, "readiness_failure_threshold", probeFlags.ReadinessFailureThreshold, "Failed probes before a pod is marked not ready.")
+	flag.IntVar(&probeFlags.LivenessFailureThreshold, "liveness_failure_threshold", probeFlags.LivenessFailureThreshold, "Failed probes before sshd is restarted.")
+	flag.StringVar(&memberKeysDirFlag, "member_keys_dir", "", "Directory of private keys named after the members to use instead of generated ones.")
+	flag.StringVar(&memberKeysFlag, "member_keys", "", "Comma separated member=file pairs of private keys to use instead of generated ones.")
+	flag.StringVar(&trustedKeysFlag, "trusted_keys", "", "Comma separated authorized_keys files, or directories of *.pub files, every member also trusts.")
+	flag.DurationVar(&keyRotationIntervalFlag, "key_rotation_interval", 0, "How old the member keys may get before the controller rotates them, e.g. 720h. 0 means never.")
+	flag.BoolVar(&restrictedFlag, "restricted", false, "Run sshd as a non-root user on a high port to pass the restricted Pod Security Standard.")
+	flag.Int64Var(&runAsUserFlag, "run_as_user", 0, "UID -restricted runs sshd as. 0 means the kssh user of the default image.")
+	flag.IntVar(&sshPortFlag, "ssh_port", 0, "Port sshd listens on with -restricted. 0 means 2222.")
+	flag.BoolVar(&waitFlag, "wait", false, "Wait until every pod is ready after deploying.")
+	flag.DurationVar(&waitTimeoutFlag, "wait_timeout", 5*time.Minute, "How long -wait waits before giving up.")
+	flag.StringVar(&onFailureFlag, "on_failure", string(k8s.FailurePolicyRollback), "What to do with the created objects when a deploy fails: rollback or keep.")
+	flag.BoolVar(&resumeFlag, "resume", false, "Resume a deploy that failed with -on_failure keep.")
+	flag.BoolVar(&skipPreflightFlag, "skip_preflight", false, "Deploy without checking names, permissions, quotas and existing objects first.")
+	flag.IntVar(&workersFlag, "workers", k8s.DefaultWorkers, "Number of concurrent key generations and API writes.")
+	flag.Float64Var(&qpsFlag, "qps", 50, "Maximum requests per second to the API server.")
+	flag.IntVar(&burstFlag, "burst", 100, "Maximum burst of requests to the API server.")
 	flag.Parse()
 }
 
+// diffErrorCode is what diff exits with on errors, like diff(1): 0 means no
+// drift and 1 drift.
+const diffErrorCode = 2
+
+// exitOnError exits for an error found before the command runs, with the
+// error code of diff when that is the command.
+func exitOnError(err error) {
+	if flag.Arg(0) != "diff" {
+		glog.Exit(err)
+	}
+	glog.Error(err)
+	glog.Flush()
+	os.Exit(diffErrorCode)
+}
+
 func main() {
 	flag.Set("logtostderr", "true")
-	clients := k8s.New(kubeconfigFlag)
-	k8s.DeployYaml(clients, namespaceFlag, namePrefixFlag, podNumFlag)
-	//k8s.DeployK8sObjects(clients.GetClientSet(), namespaceFlag, namePrefixFlag, podNumFlag)
+	spec, err := buildSpec()
+	if err != nil {
+		exitOnError(err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	// export and install -print only render, they need no cluster.
+	switch flag.Arg(0) {
+	case "export":
+		runExport(spec, flag.Args()[1:])
+		return
+	case "install":
+		runInstall(ctx, spec, flag.Args()[1:])
+		return
+	}
+
+	provisioner := newProvisioner()
+	switch command := flag.Arg(0); command {
+	case "", "deploy":
+		options := k8s.ApplyOptions{
+			OnFailure: k8s.FailurePolicy(onFailureFlag),
+			Resume:    resumeFlag,
+			Workers:   workersFlag,
+		}
+		if !skipPreflightFlag {
+			runPreflight(ctx, provisioner, spec, options)
+		}
+		if _, err := provisioner.Apply(ctx, spec, options); err != nil {
+			var applyErr *k8s.ApplyError
+			if errors.As(err, &applyErr) {
+				fmt.Fprint(os.Stderr, applyErr.Report())
+				os.Exit(1)
+			}
+			glog.Exit(err)
+		}
+		if waitFlag {
+			if err := provisioner.WaitForReady(ctx, spec, waitTimeoutFlag); err != nil {
+				glog.Exit(err)
+			}
+		}
+	case "diff":
+		runDiff(ctx, provisioner, spec)
+	case "preflight":
+		runPreflight(ctx, provisioner, spec, k8s.ApplyOptions{
+			OnFailure: k8s.FailurePolicy(onFailureFlag),
+			Resume:    resumeFlag,
+		})
+	case "run":
+		runController(ctx, provisioner, spec)
+	case "delete":
+		if err := provisioner.Delete(ctx, spec); err != nil {
+			glog.Exit(err)
+		}
+	case "status":
+		runStatus(ctx, provisioner, spec, flag.Args()[1:])
+	case "check":
+		report, err := provisioner.CheckMesh(ctx, spec.Namespace, spec.NamePrefix)
+		if err != nil {
+			glog.Exit(err)
+		}
+		if err := k8s.PrintMesh(os.Stdout, report); err != nil {
+			glog.Exitf("failed to print the check report: %v", err)
+		}
+		if !report.Complete() {
+			os.Exit(1)
+		}
+	case "bench":
+		runBench(ctx, provisioner, spec, flag.Args()[1:])
+	case "keys":
+		runKeys(ctx, provisioner, spec, flag.Args()[1:])
+	case "users":
+		if flag.Arg(1) != "sync" {
+			glog.Exitf("unknown users command %q, want sync", strings.Join(flag.Args()[1:], " "))
+		}
+		if err := provisioner.SyncUsers(ctx, spec); err != nil {
+			glog.Exit(err)
+		}
+	default:
+		glog.Exitf("unknown command %q", command)
+	}
+}
+
+// newProvisioner connects to the cluster selected by the flags.
+func newProvisioner() *k8s.Provisioner {
+	clients, err := k8s.New(k8s.ClientOptions{
+		Kubeconfig:        kubeconfigFlag,
+		Context:           contextFlag,
+		User:              userFlag,
+		Cluster:           clusterFlag,
+		Impersonate:       asFlag,
+		ImpersonateGroups: splitList(asGroupFlag),
+		QPS:               float32(qpsFlag),
+		Burst:             burstFlag,
+	})
+	if err != nil {
+		exitOnError(err)
+	}
+	return k8s.NewProvisioner(clients)
+}
+
+// buildSpec reads the -spec file, if any, and applies the flags on top. With a
+// file only the flags given explicitly override its values.
+func buildSpec() (k8s.ClusterSpec, error) {
+	spec := k8s.DefaultClusterSpec()
+	if specFlag != "" {
+		var err error
+		if spec, err = k8s.ReadClusterSpecFile(specFlag); err != nil {
+			return spec, err
+		}
+	}
+	set := func(name string) bool {
+		return specFlag == "" || isFlagSet(name)
+	}
+	if set("namespace") {
+		spec.Namespace = namespaceFlag
+	}
+	if set("name_prefix") {
+		spec.NamePrefix = namePrefixFlag
+	}
+	if set("pod_num") {
+		spec.PodNum = podNumFlag
+	}
+	if set("image") {
+		spec.Image = imageFlag
+	}
+	if set("templates_dir") {
+		spec.TemplatesDir = templatesFlag
+	}
+	if set("persistence") {
+		spec.Persistence.Enabled = persistenceFlag
+	}
+	if set("home_size") {
+		spec.Persistence.Size = homeSizeFlag
+	}
+	if set("storage_class") {
+		spec.Persistence.StorageClassName = storageClassFlag
+	}
+	if set("retention") {
+		spec.Persistence.RetentionPolicy = k8s.RetentionPolicy(retentionFlag)
+	}
+	if set("network_policy") {
+		spec.NetworkPolicy.Enabled = networkPolicyFlag
+	}
+	if set("allowed_cidrs") {
+		spec.NetworkPolicy.AllowedCIDRs = splitList(allowedCIDRsFlag)
+	}
+	if set("allowed_namespaces") {
+		spec.NetworkPolicy.AllowedNamespaces = splitList(allowedNamespacesFlag)
+	}
+	if set("probe_period") {
+		spec.Probe.PeriodSeconds = probeFlags.PeriodSeconds
+	}
+	if set("probe_timeout") {
+		spec.Probe.TimeoutSeconds = probeFlags.TimeoutSeconds
+	}
+	if set("startup_failure_threshold") {
+		spec.Probe.StartupFailureThreshold = probeFlags.StartupFailureThreshold
+	}
+	if set("readiness_failure_threshold") {
+		spec.Probe.ReadinessFailureThreshold = probeFlags.ReadinessFailureThreshold
+	}
+	if set("liveness_failure_threshold") {
+		spec.Probe.LivenessFailureThreshold = probeFlags.LivenessFailureThreshold
+	}
+	if set("member_keys_dir") {
+		spec.Keys.MemberKeysDir = memberKeysDirFlag
+	}
+	if set("member_keys") {
+		spec.Keys.MemberKeys = nil
+		for _, pair := range splitList(memberKeysFlag) {
+			member, file, ok := strings.Cut(pair, "=")
+			if !ok {
+				return spec, fmt.Errorf("invalid member key %q, want member=file", pair)
+			}
+			if spec.Keys.MemberKeys == nil {
+				spec.Keys.MemberKeys = map[string]string{}
+			}
+			spec.Keys.MemberKeys[member] = file
+		}
+	}
+	if set("trusted_keys") {
+		spec.Keys.TrustedKeys = splitList(trustedKeysFlag)
+	}
+	if set("key_rotation_interval") {
+		spec.Keys.RotationInterval = nil
+		if keyRotationIntervalFlag != 0 {
+			spec.Keys.RotationInterval = &metaV1.Duration{Duration: keyRotationIntervalFlag}
+		}
+	}
+	if set("restricted") {
+		spec.PodSecurity.Restricted = restrictedFlag
+	}
+	if set("run_as_user") {
+		spec.PodSecurity.RunAsUser = runAsUserFlag
+	}
+	if set("ssh_port") {
+		spec.PodSecurity.Port = sshPortFlag
+	}
+	return spec, nil
+}
+
+func runStatus(ctx context.Context, provisioner *k8s.Provisioner, spec k8s.ClusterSpec, args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	output := flags.String("output", "table", "Output format: table, json or yaml.")
+	watch := flags.Bool("watch", false, "Keep watching and print the status on every change.")
+	flags.Parse(args)
+
+	// Without an explicit -name_prefix or spec file every cluster in the
+	// namespace is shown.
+	namePrefix := ""
+	if isFlagSet("name_prefix") || specFlag != "" {
+		namePrefix = spec.NamePrefix
+	}
+	if !*watch {
+		statuses, err := provisioner.Status(ctx, spec.Namespace, namePrefix)
+		if err != nil {
+			glog.Exit(err)
+		}
+		if err := k8s.PrintStatus(os.Stdout, statuses, *output); err != nil {
+			glog.Exitf("failed to print status: %v", err)
+		}
+		if len(statuses) == 0 && namePrefix != "" {
+			glog.Exitf("no cluster %q in namespace %q", namePrefix, spec.Namespace)
+		}
+		if len(statuses) == 0 {
+			glog.Exitf("no cluster in namespace %q", spec.Namespace)
+		}
+		for _, status := range statuses {
+			if !status.Healthy() {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+	err := provisioner.WatchStatus(ctx, spec.Namespace, namePrefix, func(statuses []k8s.ClusterStatus) {
+		if *output == "table" {
+			fmt.Printf("\n%s\n", time.Now().Format(time.RFC3339))
+		}
+		if err := k8s.PrintStatus(os.Stdout, statuses, *output); err != nil {
+			glog.Exitf("failed to print status: %v", err)
+		}
+	})
+	if err != nil {
+		glog.Exit(err)
+	}
+}
+
+func runExport(spec k8s.ClusterSpec, args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", string(k8s.ExportFormatHelm), "What to export: helm or kustomize.")
+	out := flags.String("out", "", "Output directory. Empty means <name_prefix>-<format>.")
+	flags.Parse(args)
+
+	files, err := k8s.Export(spec, k8s.ExportFormat(*format))
+	if err != nil {
+		glog.Exit(err)
+	}
+	dir := *out
+	if dir == "" {
+		dir = spec.NamePrefix + "-" + *format
+	}
+	if err := k8s.WriteExport(dir, files); err != nil {
+		glog.Exitf("failed to write the export: %v", err)
+	}
+	glog.Infof("exported %d files to %s", len(files), dir)
 }
 
-func buildK8sClient(kubeconfigPath string) *kubernetes.Clientset {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+// runDiff prints a unified diff for every object that drifted from spec.
+func runDiff(ctx context.Context, provisioner *k8s.Provisioner, spec k8s.ClusterSpec) {
+	diffs, err := provisioner.Diff(ctx, spec)
 	if err != nil {
-		glog.Fatalf("fail to build k8s config: %v", err)
+		exitOnError(err)
+	}
+	drifted := 0
+	for _, diff := range diffs {
+		if diff.Diff == "" {
+			continue
+		}
+		drifted++
+		if diff.Missing {
+			glog.Infof("%s %q is missing", diff.Kind, diff.Name)
+		}
+		fmt.Print(diff.Diff)
+	}
+	glog.Infof("%d of %d objects drifted", drifted, len(diffs))
+	if drifted != 0 {
+		os.Exit(1)
+	}
+}
+
+// runPreflight exits listing every problem when a deploy would fail.
+func runPreflight(ctx context.Context, provisioner *k8s.Provisioner, spec k8s.ClusterSpec, options k8s.ApplyOptions) {
+	err := provisioner.Preflight(ctx, spec, options)
+	var preflightErr *k8s.PreflightError
+	if errors.As(err, &preflightErr) {
+		fmt.Fprintln(os.Stderr, preflightErr.Error())
+		os.Exit(1)
+	}
+	if err != nil {
+		glog.Exit(err)
+	}
+}
+
+func runInstall(ctx context.Context, spec k8s.ClusterSpec, args []string) {
+	flags := flag.NewFlagSet("install", flag.ExitOnError)
+	scope := flags.String("scope", string(k8s.InstallScopeNamespace), "Where the controller manages clusters: namespace or cluster.")
+	image := flags.String("controller_image", "", "Image running the controller. Empty means the default image.")
+	print := flags.Bool("print", false, "Print the manifests instead of applying them.")
+	check := flags.Bool("check", false, "Only report the permissions of the controller and of the commands the current user lacks.")
+	flags.Parse(args)
+
+	options := k8s.InstallOptions{Scope: k8s.InstallScope(*scope), Image: *image}
+	if *print {
+		objs, err := k8s.GenerateInstallObjs(spec, options)
+		if err != nil {
+			glog.Exit(err)
+		}
+		if err := k8s.PrintObjects(os.Stdout, objs); err != nil {
+			glog.Exitf("failed to print the manifests: %v", err)
+		}
+		return
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+	provisioner := newProvisioner()
+	if *check {
+		missing, err := provisioner.CheckPermissions(ctx, spec.Namespace, options.Scope)
+		if err != nil {
+			glog.Exit(err)
+		}
+		commandMissing, err := provisioner.CheckCommandPermissions(ctx, spec.Namespace)
+		if err != nil {
+			glog.Exit(err)
+		}
+		if len(missing) != 0 {
+			fmt.Fprintf(os.Stderr, "to install the controller you are %s\n",
+				(&k8s.PermissionError{Missing: missing}).Error())
+		}
+		if len(commandMissing) != 0 {
+			fmt.Fprintf(os.Stderr, "to run the commands yourself you are %s\n",
+				(&k8s.PermissionError{Missing: commandMissing}).Error())
+		}
+		if len(missing) != 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	objs, err := provisioner.Install(ctx, spec, options)
 	if err != nil {
-		glog.Fatalf("fail to build k8s client set: %v", err)
+		glog.Exit(err)
+	}
+	glog.Infof("installed %d objects", len(objs))
+}
+
+// runController is what an installed controller runs: it deploys the spec,
+// resuming whatever an earlier run created, and logs its status until it is
+// stopped. With keys.rotationInterval it also rotates the member keys.
+func runController(ctx context.Context, provisioner *k8s.Provisioner, spec k8s.ClusterSpec) {
+	options := k8s.ApplyOptions{
+		OnFailure:       k8s.FailurePolicyKeep,
+		Resume:          true,
+		Workers:         workersFlag,
+		AssumeNamespace: true,
+	}
+	if _, err := provisioner.Apply(ctx, spec, options); err != nil {
+		glog.Exit(err)
+	}
+	go provisioner.RotateKeysOnSchedule(ctx, spec, k8s.RotateOptions{
+		Timeout: waitTimeoutFlag,
+		Workers: workersFlag,
+	})
+	err := provisioner.WatchStatus(ctx, spec.Namespace, spec.NamePrefix, func(statuses []k8s.ClusterStatus) {
+		if err := k8s.PrintStatus(os.Stdout, statuses, "json"); err != nil {
+			glog.Errorf("failed to print status: %v", err)
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		glog.Exit(err)
+	}
+}
+
+func runKeys(ctx context.Context, provisioner *k8s.Provisioner, spec k8s.ClusterSpec, args []string) {
+	if len(args) != 0 && args[0] == "rotate" {
+		runRotate(ctx, provisioner, spec, args[1:])
+		return
+	}
+	if len(args) != 0 && args[0] == "revoke" {
+		runRevoke(ctx, provisioner, spec, args[1:])
+		return
+	}
+	if len(args) == 0 || args[0] != "export" {
+		glog.Exitf("unknown keys command %q, want export, rotate or revoke", strings.Join(args, " "))
+	}
+	flags := flag.NewFlagSet("keys export", flag.ExitOnError)
+	out := flags.String("out", "", "Output directory. Empty means <name_prefix>-keys.")
+	flags.Parse(args[1:])
+
+	dir := *out
+	if dir == "" {
+		dir = spec.NamePrefix + "-keys"
+	}
+	written, err := provisioner.ExportKeys(ctx, spec, dir)
+	if err != nil {
+		glog.Exit(err)
+	}
+	glog.Infof("exported %d files to %s", len(written), dir)
+}
+
+func runRotate(ctx context.Context, provisioner *k8s.Provisioner, spec k8s.ClusterSpec, args []string) {
+	flags := flag.NewFlagSet("keys rotate", flag.ExitOnError)
+	parallel := flags.Int("parallel", 1, "Members restarted at once.")
+	timeout := flags.Duration("timeout", waitTimeoutFlag, "How long the rollout of each member may take.")
+	flags.Parse(args)
+
+	err := provisioner.RotateKeys(ctx, spec, k8s.RotateOptions{
+		Parallel: *parallel,
+		Timeout:  *timeout,
+		Workers:  workersFlag,
+	})
+	if err != nil {
+		glog.Exit(err)
+	}
+}
+
+func runRevoke(ctx context.Context, provisioner *k8s.Provisioner, spec k8s.ClusterSpec, args []string) {
+	flags := flag.NewFlagSet("keys revoke", flag.ExitOnError)
+	member := flags.String("member", "", "Member whose key is revoked.")
+	key := flags.String("key", "", "An authorized_keys line to revoke.")
+	keyFile := flags.String("key_file", "", "An authorized_keys file whose keys are revoked.")
+	name := flags.String("name", "", "Who the keys of -key and -key_file belong to, recorded with them.")
+	flags.Parse(args)
+
+	options := k8s.RevokeOptions{Member: *member, Name: *name}
+	if *key != "" {
+		options.Keys = append(options.Keys, *key)
+	}
+	if *keyFile != "" {
+		content, err := os.ReadFile(*keyFile)
+		if err != nil {
+			glog.Exit(err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				options.Keys = append(options.Keys, line)
+			}
+		}
+	}
+	revoked, err := provisioner.Revoke(ctx, spec, options)
+	if err != nil {
+		glog.Exit(err)
+	}
+	for _, key := range revoked {
+		fmt.Printf("%s\t%s\n", key.Name, key.Fingerprint)
+	}
+}
+
+func runBench(ctx context.Context, provisioner *k8s.Provisioner, spec k8s.ClusterSpec, args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	pairs := flags.String("pairs", "", "Comma separated source:target member pairs. Empty means all pairs.")
+	sizeMiB := flags.Int64("size_mib", 100, "MiB streamed for each throughput test.")
+	samples := flags.Int("latency_samples", 10, "Round trips measured for each latency test.")
+	pairTimeout := flags.Duration("pair_timeout", k8s.DefaultBenchPairTimeout, "How long the tests of each pair may take.")
+	flags.Parse(args)
+
+	options := k8s.BenchOptions{
+		Bytes:          *sizeMiB << 20,
+		LatencySamples: *samples,
+		PairTimeout:    *pairTimeout,
+	}
+	for _, pair := range splitList(*pairs) {
+		source, target, ok := strings.Cut(pair, ":")
+		if !ok {
+			glog.Exitf("invalid pair %q, want source:target", pair)
+		}
+		options.Pairs = append(options.Pairs, [2]string{source, target})
+	}
+	report, err := provisioner.BenchMesh(ctx, spec.Namespace, spec.NamePrefix, options)
+	if err != nil {
+		glog.Exit(err)
+	}
+	if err := k8s.PrintBench(os.Stdout, report); err != nil {
+		glog.Exitf("failed to print the bench report: %v", err)
+	}
+	if !report.Complete() {
+		os.Exit(1)
+	}
+}
+
+// isFlagSet reports whether a global flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	return clientset
+	return items
 }